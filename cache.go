@@ -29,7 +29,36 @@ func newCache(options Options) *Cache {
 // Get the cached data for a request. An empty byte array will be returned if
 // the entry doesn't exist or can't be read for any reason.
 func (cache *Cache) Get(cacheKey *CacheKey) (data []byte, age time.Duration, err error) {
-	path := cache.diskpath(cacheKey)
+	return cache.read(cache.diskpath(cacheKey))
+}
+
+// Set cached data for a request.
+func (cache *Cache) Set(cacheKey *CacheKey, data []byte) error {
+	return cache.write(cache.diskpath(cacheKey), data)
+}
+
+// GetMeta returns metadata stored next to the cached data for a request, like
+// a redirect chain. Behaves like Get.
+func (cache *Cache) GetMeta(cacheKey *CacheKey, name string) (data []byte, age time.Duration, err error) {
+	return cache.read(cache.metapath(cacheKey, name))
+}
+
+// SetMeta stores metadata next to the cached data for a request.
+func (cache *Cache) SetMeta(cacheKey *CacheKey, name string, data []byte) error {
+	return cache.write(cache.metapath(cacheKey, name), data)
+}
+
+// RemoveMeta unlinks metadata stored next to the cached data for a request.
+// It is not an error if the metadata doesn't exist.
+func (cache *Cache) RemoveMeta(cacheKey *CacheKey, name string) error {
+	err := os.Remove(cache.metapath(cacheKey, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (cache *Cache) read(path string) (data []byte, age time.Duration, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return
@@ -48,20 +77,19 @@ func (cache *Cache) Get(cacheKey *CacheKey) (data []byte, age time.Duration, err
 	return
 }
 
-// Set cached data for a request.
-func (cache *Cache) Set(cacheKey *CacheKey, data []byte) error {
+func (cache *Cache) write(diskpath string, data []byte) error {
 	// make sure directory exists
-	diskpath := cache.diskpath(cacheKey)
 	if err := os.MkdirAll(filepath.Dir(diskpath), os.ModePerm); err != nil {
 		return err
 	}
 
-	// write to tmp file in same directory
-	tmp := filepath.Join(filepath.Dir(diskpath), fmt.Sprintf(".tmp-%s", filepath.Base(diskpath)))
-	f, err := os.Create(tmp)
+	// write to unique tmp file in same directory, so concurrent writers don't
+	// collide
+	f, err := ioutil.TempFile(filepath.Dir(diskpath), fmt.Sprintf(".tmp-%s-*", filepath.Base(diskpath)))
 	if err != nil {
 		return err
 	}
+	tmp := f.Name()
 	defer os.Remove(tmp)
 
 	// write compressed data
@@ -98,6 +126,14 @@ func (cache *Cache) Touch(cacheKey *CacheKey) error {
 	return os.Chtimes(path, currentTime, currentTime)
 }
 
+// RemovePartition unlinks all entries in a single partition.
+func (cache *Cache) RemovePartition(partition string) error {
+	if partition == "" {
+		return fmt.Errorf("partition required")
+	}
+	return os.RemoveAll(filepath.Join(cache.Dir, partitionDir(partition)))
+}
+
 // RemoveAll unlinks the cache.
 func (cache *Cache) RemoveAll() error {
 	return os.RemoveAll(cache.Dir)
@@ -111,6 +147,10 @@ func (cache *Cache) diskpath(cacheKey *CacheKey) string {
 	return filepath.Join(cache.Dir, cacheKey.Diskpath(cache.NoHosts))
 }
 
+func (cache *Cache) metapath(cacheKey *CacheKey, name string) string {
+	return fmt.Sprintf("%s.%s", cache.diskpath(cacheKey), name)
+}
+
 func (cache *Cache) age(path string) time.Duration {
 	stat, err := os.Stat(path)
 	if err != nil {
@@ -1,9 +1,11 @@
 package gohttpdisk
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -13,9 +15,19 @@ import (
 	"strings"
 )
 
+// Request bodies longer than this are replaced by their md5 sum in the key.
+const maxBodyKeyLength = 1024
+
 // a key in the cache
 type CacheKey struct {
 	Request *http.Request
+
+	// Optional partition, stored as an extra directory level so that
+	// partitions can be purged independently. See WithPartition.
+	Partition string
+
+	// memoized result of Key()
+	key string
 }
 
 func NewCacheKey(req *http.Request) (*CacheKey, error) {
@@ -25,13 +37,26 @@ func NewCacheKey(req *http.Request) (*CacheKey, error) {
 	if req.URL.Host == "" {
 		return nil, fmt.Errorf("host required (%s)", req.URL.String())
 	}
-	return &CacheKey{req}, nil
+	req, err := withGetBody(req)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := &CacheKey{Request: req, Partition: PartitionFromContext(req.Context())}
+	if cacheKey.key, err = cacheKey.calculateKey(); err != nil {
+		return nil, err
+	}
+	return cacheKey, nil
 }
 
-// Key calculates a canonical cache key for the request based on the http
-// method, the normalized URL, and the request body if present. The key can be
-// quite long since it contains the request body.
+// Key returns a canonical cache key for the request based on the http method,
+// the normalized URL, and the request body if present. Small bodies are
+// included verbatim, larger bodies are included as an md5 sum. The key is
+// calculated once, by NewCacheKey.
 func (cacheKey *CacheKey) Key() string {
+	return cacheKey.key
+}
+
+func (cacheKey *CacheKey) calculateKey() (string, error) {
 	method := strings.ToUpper(cacheKey.Request.Method)
 	if method == "" {
 		method = "GET"
@@ -66,11 +91,15 @@ func (cacheKey *CacheKey) Key() string {
 		key = append(key, querykey(query))
 	}
 	if cacheKey.Request.GetBody != nil {
+		body, err := bodykey(cacheKey.Request)
+		if err != nil {
+			return "", err
+		}
 		key = append(key, " ")
-		key = append(key, bodykey(cacheKey.Request))
+		key = append(key, body)
 	}
 
-	return strings.Join(key, "")
+	return strings.Join(key, ""), nil
 }
 
 // Digest returns the md5 sum for this request.
@@ -82,6 +111,11 @@ func (cacheKey *CacheKey) Digest() string {
 func (cacheKey *CacheKey) Diskpath(noHosts bool) string {
 	paths := []string{}
 
+	if cacheKey.Partition != "" {
+		// Partition dir
+		paths = append(paths, partitionDir(cacheKey.Partition))
+	}
+
 	if !noHosts {
 		// Host dir
 		paths = append(paths, normalizeHostForPath(cacheKey.Request.URL.Hostname()))
@@ -112,17 +146,57 @@ func querykey(query url.Values) string {
 	return query.Encode() // note: sorts by key
 }
 
-func bodykey(req *http.Request) string {
+// bodykey returns the body itself if it is short, or an md5 sum of the body.
+// The body is streamed through the hash so it is never held in memory twice.
+// A body that can't be read is an error, rather than a key that would match
+// every other unreadable body.
+func bodykey(req *http.Request) (string, error) {
 	reader, err := req.GetBody()
 	if err != nil {
-		return ""
+		return "", err
 	}
 	defer reader.Close()
-	data, err := ioutil.ReadAll(reader)
+
+	// read just enough to know whether the body is short
+	prefix, err := ioutil.ReadAll(io.LimitReader(reader, maxBodyKeyLength+1))
+	if err != nil {
+		return "", err
+	}
+	if len(prefix) <= maxBodyKeyLength {
+		return string(prefix), nil
+	}
+
+	hash := md5.New()
+	hash.Write(prefix)
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("md5:%s", hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// Requests built by hand may have a Body but no GetBody. We need GetBody to
+// calculate the key (and to resend the body), so buffer the body into a copy
+// of the request that has one. Without this, requests with different bodies
+// would share a key. The caller's request isn't modified, although its body
+// is consumed, just as sending it would.
+func withGetBody(req *http.Request) (*http.Request, error) {
+	if req.GetBody != nil || req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
 	if err != nil {
-		return ""
+		return nil, err
 	}
-	return string(data)
+
+	req = req.Clone(req.Context())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(data))
+	return req, nil
 }
 
 var (
@@ -138,6 +212,19 @@ func normalizeHostForPath(s string) string {
 	return s
 }
 
+var partitionCharsRe = regexp.MustCompile("[^A-Za-z0-9_-]+")
+
+// Turn a partition name into a directory name. The @ prefix can't appear in a
+// hostname, so partitions never collide with host dirs. If the name had to be
+// altered, a checksum is appended to keep distinct partitions apart.
+func partitionDir(partition string) string {
+	s := partitionCharsRe.ReplaceAllString(partition, "")
+	if s != partition {
+		s = fmt.Sprintf("%s-%s", s, md5String(partition)[0:8])
+	}
+	return "@" + s
+}
+
 func md5String(text string) string {
 	hash := md5.Sum([]byte(text))
 	return hex.EncodeToString(hash[:])
@@ -1,12 +1,17 @@
 package gohttpdisk
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -39,6 +44,48 @@ func TestCacheKeys(t *testing.T) {
 	req1, _ := http.NewRequest("POST", "http://a.com", strings.NewReader("abc"))
 	req2, _ := http.NewRequest("POST", "http://a.com", strings.NewReader("def"))
 	assertDiffer(req1, req2)
+
+	// bodies without GetBody, keys differ
+	req1, _ = http.NewRequest("POST", "http://a.com", ioutil.NopCloser(strings.NewReader("abc")))
+	req2, _ = http.NewRequest("POST", "http://a.com", ioutil.NopCloser(strings.NewReader("def")))
+	assertDiffer(req1, req2)
+}
+
+func TestCacheKeyLargeBody(t *testing.T) {
+	large := strings.Repeat("x", maxBodyKeyLength*10)
+
+	req, _ := http.NewRequest("POST", "http://a.com", strings.NewReader(large))
+	key := MustCacheKey(req).Key()
+	assert.Less(t, len(key), maxBodyKeyLength)
+	assert.Contains(t, key, "md5:")
+
+	// large bodies that differ still produce different keys
+	req2, _ := http.NewRequest("POST", "http://a.com", strings.NewReader(large+"y"))
+	assert.NotEqual(t, key, MustCacheKey(req2).Key())
+
+	// body can still be read after calculating the key, from a copy of the
+	// request. The caller's request is left alone.
+	req3, _ := http.NewRequest("POST", "http://a.com", ioutil.NopCloser(strings.NewReader(large)))
+	ck := MustCacheKey(req3)
+	assert.Equal(t, key, ck.Key())
+	assert.Nil(t, req3.GetBody)
+	assert.NotSame(t, req3, ck.Request)
+	data, _ := ioutil.ReadAll(ck.Request.Body)
+	assert.Equal(t, large, string(data))
+}
+
+func TestCacheKeyBodyError(t *testing.T) {
+	// unreadable bodies don't share the key of an empty body
+	req, _ := http.NewRequest("POST", "http://a.com", strings.NewReader("abc"))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(iotest.ErrReader(errors.New("boom"))), nil
+	}
+	_, err := NewCacheKey(req)
+	assert.Error(t, err)
+
+	req.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("boom") }
+	_, err = NewCacheKey(req)
+	assert.Error(t, err)
 }
 
 func TestCacheHost(t *testing.T) {
@@ -61,3 +108,15 @@ func TestCacheHost(t *testing.T) {
 		assert.Regexp(t, noHostPathRE, path)
 	}
 }
+
+func TestCacheKeyPartition(t *testing.T) {
+	req := MustRequest("GET", "http://a.com")
+	req = req.WithContext(WithPartition(req.Context(), "acct1"))
+	ck := MustCacheKey(req)
+	assert.Equal(t, "acct1", ck.Partition)
+	assert.True(t, strings.HasPrefix(ck.Diskpath(false), filepath.Join("@acct1", "a.com")))
+
+	// names are sanitized but stay distinct
+	assert.NotEqual(t, partitionDir("a/b"), partitionDir("a.b"))
+	assert.NotContains(t, partitionDir("../.."), ".")
+}
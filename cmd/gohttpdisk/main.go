@@ -19,10 +19,12 @@ import (
 //
 
 type Args struct {
-	dir     string
-	nohosts bool
-	status  bool
-	u       *url.URL
+	dir       string
+	nohosts   bool
+	partition string
+	request   bool
+	status    bool
+	u         *url.URL
 }
 
 func main() {
@@ -36,8 +38,8 @@ func main() {
 		fmt.Fprintln(os.Stderr, "gohttpdisk: try 'gohttpdisk --help' for more information")
 		os.Exit(1)
 	}
-	if !args.status {
-		fmt.Println("sorry, the only thing we support is --status")
+	if !args.status && !args.request {
+		fmt.Println("sorry, the only things we support are --status and --request")
 		os.Exit(1)
 	}
 
@@ -46,7 +48,7 @@ func main() {
 
 	// status
 	if args.status {
-		status, err := status(hd, args.u)
+		status, err := status(hd, args.u, args.partition)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error %s\n", err.Error())
 			os.Exit(1)
@@ -55,17 +57,43 @@ func main() {
 		fmt.Printf("url: %q\n", status.URL)
 		fmt.Printf("status: %q\n", status.Status)
 		fmt.Printf("key: %q\n", status.Key)
+		if status.Partition != "" {
+			fmt.Printf("partition: %q\n", status.Partition)
+		}
 		fmt.Printf("digest: %q\n", status.Digest)
 		fmt.Printf("path: %q\n", status.Path)
 		if status.Age > 0 {
 			fmt.Printf("age: %q\n", status.Age.Truncate(time.Second))
 		}
+		if status.RemoteAddr != "" {
+			fmt.Printf("remote_addr: %q\n", status.RemoteAddr)
+		}
+		if status.Redirects != nil {
+			for _, hop := range status.Redirects.Hops {
+				fmt.Printf("redirect: %d %q => %q\n", hop.Status, hop.URL, hop.Location)
+			}
+			fmt.Printf("final: %q\n", status.Redirects.FinalURL)
+		}
 
 	}
+
+	// request
+	if args.request {
+		dump, err := requestDump(hd, args.u, args.partition)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error %s\n", err.Error())
+			os.Exit(1)
+		}
+		if dump == nil {
+			fmt.Fprintln(os.Stderr, "no request stored for this url")
+			os.Exit(1)
+		}
+		os.Stdout.Write(dump)
+	}
 }
 
-func status(hd *gohttpdisk.HTTPDisk, u *url.URL) (*gohttpdisk.Status, error) {
-	request, err := http.NewRequest("GET", u.String(), nil)
+func status(hd *gohttpdisk.HTTPDisk, u *url.URL, partition string) (*gohttpdisk.Status, error) {
+	request, err := newRequest(u, partition)
 	if err != nil {
 		return nil, err
 	}
@@ -76,6 +104,25 @@ func status(hd *gohttpdisk.HTTPDisk, u *url.URL) (*gohttpdisk.Status, error) {
 	return status, nil
 }
 
+func requestDump(hd *gohttpdisk.HTTPDisk, u *url.URL, partition string) ([]byte, error) {
+	request, err := newRequest(u, partition)
+	if err != nil {
+		return nil, err
+	}
+	return hd.RequestDump(request)
+}
+
+func newRequest(u *url.URL, partition string) (*http.Request, error) {
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if partition != "" {
+		request = request.WithContext(gohttpdisk.WithPartition(request.Context(), partition))
+	}
+	return request, nil
+}
+
 //
 // cli
 //
@@ -91,6 +138,8 @@ func cli() (*Args, error) {
 	defaultDir := filepath.Join(os.Getenv("HOME"), "gohttpdisk")
 	dir := cli.String("dir", defaultDir, "cache directory")
 	nohosts := cli.Bool("nohosts", false, "don't include hostname in cache path")
+	partition := cli.String("partition", "", "cache partition")
+	request := cli.Bool("request", false, "show the request that produced a cached url")
 	status := cli.Bool("status", false, "show status for a url in the cache")
 	help := cli.BoolP("help", "h", false, "show this help")
 
@@ -124,9 +173,11 @@ func cli() (*Args, error) {
 	}
 
 	return &Args{
-		dir:     *dir,
-		nohosts: *nohosts,
-		status:  *status,
-		u:       u,
+		dir:       *dir,
+		nohosts:   *nohosts,
+		partition: *partition,
+		request:   *request,
+		status:    *status,
+		u:         u,
 	}, nil
 }
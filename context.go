@@ -0,0 +1,63 @@
+package gohttpdisk
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	partitionContextKey contextKey = iota
+	requestOptionsContextKey
+)
+
+// WithPartition returns a context that places requests into a separate cache
+// partition, such as an account or session id. Use it with
+// http.Request.WithContext.
+func WithPartition(ctx context.Context, partition string) context.Context {
+	return context.WithValue(ctx, partitionContextKey, partition)
+}
+
+// PartitionFromContext returns the partition set by WithPartition, if any.
+func PartitionFromContext(ctx context.Context) string {
+	partition, _ := ctx.Value(partitionContextKey).(string)
+	return partition
+}
+
+// RequestOptions override Options for a single request. See
+// WithRequestOptions.
+type RequestOptions struct {
+	// Don't read anything from cache (but still write), like Options.Force
+	Force bool
+
+	// Don't read errors from cache (but still write), like Options.ForceErrors
+	ForceErrors bool
+
+	// Don't read from or write to the cache at all
+	Bypass bool
+
+	// Don't write the response to the cache
+	NoStore bool
+
+	// Never use the network. Cached responses are returned even if they are
+	// stale, otherwise ErrCacheMiss is returned. Takes precedence over Force,
+	// Bypass and Bypass rules, which would otherwise skip the cache.
+	CacheOnly bool
+
+	// If positive, overrides Options.MaxAge for this request.
+	MaxAge time.Duration
+}
+
+// WithRequestOptions returns a context that overrides Options for a single
+// request. Use it with http.Request.WithContext.
+func WithRequestOptions(ctx context.Context, options RequestOptions) context.Context {
+	return context.WithValue(ctx, requestOptionsContextKey, options)
+}
+
+// RequestOptionsFromContext returns the options set by WithRequestOptions, if
+// any.
+func RequestOptionsFromContext(ctx context.Context) (RequestOptions, bool) {
+	options, ok := ctx.Value(requestOptionsContextKey).(RequestOptions)
+	return options, ok
+}
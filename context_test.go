@@ -0,0 +1,79 @@
+package gohttpdisk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestOptions(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &counterRoundTripper{}
+
+	get := func(url string, ro *RequestOptions) (string, error) {
+		req := MustRequest("GET", url)
+		if ro != nil {
+			req = req.WithContext(WithRequestOptions(req.Context(), *ro))
+		}
+		resp, err := hd.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		return resp.Header.Get("X-Request-Id"), nil
+	}
+	mustGet := func(url string, ro *RequestOptions) string {
+		id, err := get(url, ro)
+		if err != nil {
+			t.Fatalf("Get %s failed %s", url, err)
+		}
+		return id
+	}
+
+	url := "http://httpbingo.org/get"
+
+	// cache only, miss
+	_, err := get(url, &RequestOptions{CacheOnly: true})
+	assert.True(t, errors.Is(err, ErrCacheMiss))
+
+	// no store, then miss again
+	assert.Equal(t, "1", mustGet(url, &RequestOptions{NoStore: true}))
+	assert.Equal(t, "2", mustGet(url, nil))
+	assert.Equal(t, "2", mustGet(url, nil))
+
+	// force refresh
+	assert.Equal(t, "3", mustGet(url, &RequestOptions{Force: true}))
+	assert.Equal(t, "3", mustGet(url, nil))
+
+	// bypass
+	assert.Equal(t, "4", mustGet(url, &RequestOptions{Bypass: true}))
+	assert.Equal(t, "3", mustGet(url, nil))
+
+	// max age
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "3", mustGet(url, &RequestOptions{MaxAge: time.Hour}))
+	assert.Equal(t, "5", mustGet(url, &RequestOptions{MaxAge: 10 * time.Millisecond}))
+
+	// cache only, hit
+	assert.Equal(t, "5", mustGet(url, &RequestOptions{CacheOnly: true}))
+
+	// cache only wins over force and bypass
+	assert.Equal(t, "5", mustGet(url, &RequestOptions{CacheOnly: true, Force: true}))
+	assert.Equal(t, "5", mustGet(url, &RequestOptions{CacheOnly: true, Bypass: true}))
+	hd.Options.Rules = []Rule{{Policy: Policy{Bypass: true}}}
+	assert.Equal(t, "5", mustGet(url, &RequestOptions{CacheOnly: true}))
+}
+
+func TestPartitionFromContext(t *testing.T) {
+	req := MustRequest("GET", "http://a.com")
+	assert.Equal(t, "", PartitionFromContext(req.Context()))
+
+	req = req.WithContext(WithPartition(req.Context(), "acct1"))
+	assert.Equal(t, "acct1", PartitionFromContext(req.Context()))
+
+	_, ok := RequestOptionsFromContext(req.Context())
+	assert.False(t, ok)
+}
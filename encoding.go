@@ -0,0 +1,102 @@
+package gohttpdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// Bodies are always stored decoded, no matter what the Transport gave us. Go's
+// default transport decodes gzip itself but leaves a stale Content-Length,
+// while a transport with DisableCompression returns the raw gzip body. Either
+// way the stored entry ends up without Content-Encoding, and with a
+// Content-Length that matches the stored body.
+
+// Decode the body if it has a Content-Encoding that we understand, and fix up
+// the headers to match. Bodies that can't be decoded are returned unchanged.
+func normalizeEncoding(req *http.Request, resp *http.Response, body []byte) []byte {
+	if methodOrGet(req) == "HEAD" {
+		// no body, Content-Length describes the GET
+		return body
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		decoded, err := decodeBody(encoding, body)
+		if err != nil {
+			return body
+		}
+		resp.Header.Del("Content-Encoding")
+		body = decoded
+	}
+
+	setContentLength(resp, body)
+	return body
+}
+
+// Decode a body with a single Content-Encoding.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is supposed to be zlib, but some servers send raw deflate
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Gzip a response for callers that asked for encoded responses with
+// Options.GzipResponses. This is the very last step, so that everything else
+// works with decoded bodies. Streaming responses are left alone, and so are
+// partial responses since their Content-Range counts decoded bytes.
+func gzipResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if methodOrGet(req) == "HEAD" || isStreaming(resp) || resp.StatusCode == http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		resp.Body = http.NoBody
+		return resp, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(body)
+	gz.Close()
+
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Uncompressed = false
+	setContentLength(resp, buf.Bytes())
+	resp.Body = ioutil.NopCloser(&buf)
+	return resp, nil
+}
+
+func setContentLength(resp *http.Response, body []byte) {
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
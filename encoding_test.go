@@ -0,0 +1,147 @@
+package gohttpdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipString(s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestContentEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipString("hello world"))
+	}))
+	defer server.Close()
+
+	transports := map[string]http.RoundTripper{
+		"default":            &http.Transport{},
+		"DisableCompression": &http.Transport{DisableCompression: true},
+	}
+	for name, transport := range transports {
+		hd := TmpHTTPDisk(t, Options{})
+		hd.Transport = transport
+
+		// network, then cache
+		for i := 0; i < 2; i++ {
+			resp, err := hd.RoundTrip(MustRequest("GET", server.URL))
+			if !assert.NoError(t, err, name) {
+				continue
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, "hello world", string(body), name)
+			assert.Equal(t, "", resp.Header.Get("Content-Encoding"), name)
+			assert.Equal(t, "11", resp.Header.Get("Content-Length"), name)
+			assert.Equal(t, int64(11), resp.ContentLength, name)
+		}
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{GzipResponses: true})
+	hd.Transport = &counterRoundTripper{}
+
+	for i := 0; i < 2; i++ {
+		resp, err := hd.RoundTrip(MustRequest("GET", "http://example.com"))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, fmt.Sprint(len(data)), resp.Header.Get("Content-Length"))
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(gz)
+			assert.Equal(t, "body 1", string(body))
+		}
+	}
+
+	// stored decoded
+	data, _, _ := hd.Cache.Get(MustCacheKey(MustRequest("GET", "http://example.com")))
+	assert.Contains(t, string(data), "body 1")
+	assert.NotContains(t, string(data), "Content-Encoding")
+}
+
+func TestGzipResponsesRangeAndHead(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{GzipResponses: true, HeadFromGet: true})
+	hd.Transport = &counterRoundTripper{}
+	url := "http://example.com"
+	hd.RoundTrip(MustRequest("GET", url))
+
+	// ranges are cut from the decoded body, and aren't gzipped
+	req := MustRequest("GET", url)
+	req.Header.Set("Range", "bytes=0-3")
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "body", string(body))
+	}
+
+	// HEAD reports the decoded length
+	resp, err = hd.RoundTrip(MustRequest("HEAD", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "6", resp.Header.Get("Content-Length"))
+	}
+}
+
+func TestEncodedEntryReplay(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{})
+
+	// an entry stored encoded, by an older version
+	compressed := gzipString("hello world")
+	dump := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n%s", len(compressed), compressed)
+	req := MustRequest("GET", "http://example.com")
+	hd.Cache.Set(MustCacheKey(req), []byte(dump))
+
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello world", string(body))
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "11", resp.Header.Get("Content-Length"))
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var zbuf, fbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write([]byte("zlib"))
+	zw.Close()
+	fw, _ := flate.NewWriter(&fbuf, flate.DefaultCompression)
+	fw.Write([]byte("raw"))
+	fw.Close()
+
+	body, err := decodeBody("deflate", zbuf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "zlib", string(body))
+
+	body, err = decodeBody("deflate", fbuf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, "raw", string(body))
+
+	body, err = decodeBody("x-gzip", gzipString("gzip"))
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", string(body))
+
+	_, err = decodeBody("br", []byte("whatever"))
+	assert.Error(t, err)
+}
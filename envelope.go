@@ -0,0 +1,282 @@
+package gohttpdisk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cached responses are stored as envPrefix, a JSON envelope, a newline and
+// then the response dump. The envelope holds the details that a dump loses.
+// Older entries are just the dump.
+const envPrefix = "env:"
+
+type envelope struct {
+	Proto   string      `json:"proto"`
+	TLS     *tlsDetails `json:"tls,omitempty"`
+	Trailer http.Header `json:"trailer,omitempty"`
+	// address of the server that sent the response
+	RemoteAddr string       `json:"remote_addr,omitempty"`
+	Request    *sentRequest `json:"request,omitempty"`
+}
+
+// The parts of tls.ConnectionState worth keeping.
+type tlsDetails struct {
+	Version            uint16     `json:"version"`
+	CipherSuite        uint16     `json:"cipher_suite"`
+	ServerName         string     `json:"server_name"`
+	NegotiatedProtocol string     `json:"negotiated_protocol,omitempty"`
+	Peers              []peerCert `json:"peers,omitempty"`
+	// DER of each certificate, only with Options.StoreCertificates
+	Certificates [][]byte `json:"certificates,omitempty"`
+}
+
+// Summary of a peer certificate, for reading the envelope by hand.
+type peerCert struct {
+	// sha256 of the DER
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// The request that was actually sent, which may differ from the caller's
+// because of conditional or Range headers.
+type sentRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// headers and body, with sensitive headers redacted. Bodies longer than
+	// maxBodyKeyLength are left out, and only their length and md5 are kept.
+	Dump       []byte `json:"dump,omitempty"`
+	BodyLength int64  `json:"body_length,omitempty"`
+	BodyMD5    string `json:"body_md5,omitempty"`
+}
+
+// Request headers that are redacted by default, see Options.RedactHeaders.
+var defaultRedactHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Wrap a response dump in an envelope. remoteAddr is the server that sent
+// resp, if known.
+func (hd *HTTPDisk) encodeEnvelope(resp *http.Response, dump []byte, remoteAddr string) ([]byte, error) {
+	env := &envelope{Proto: resp.Proto, Trailer: resp.Trailer, RemoteAddr: remoteAddr}
+	if resp.TLS != nil {
+		env.TLS = newTLSDetails(resp.TLS, hd.Options.StoreCertificates)
+	}
+	if resp.Request != nil {
+		redact := hd.Options.RedactHeaders
+		if redact == nil {
+			redact = defaultRedactHeaders
+		}
+		sent, err := newSentRequest(resp.Request, redact)
+		if err != nil {
+			return nil, err
+		}
+		env.Request = sent
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBufferString(envPrefix)
+	buf.Write(data)
+	buf.WriteByte('\n')
+	buf.Write(dump)
+	return buf.Bytes(), nil
+}
+
+// Split a cache entry into its envelope and dump. The envelope is nil for
+// older entries.
+func decodeEnvelope(data []byte) (*envelope, []byte) {
+	if !bytes.HasPrefix(data, []byte(envPrefix)) {
+		return nil, data
+	}
+	data = data[len(envPrefix):]
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, data
+	}
+	env := &envelope{}
+	if err := json.Unmarshal(data[:i], env); err != nil {
+		return nil, data[i+1:]
+	}
+	return env, data[i+1:]
+}
+
+// Restore the details from the envelope onto a replayed response. resp.Request
+// becomes the request that was sent, on top of the request that replayed it.
+func (env *envelope) apply(resp *http.Response) {
+	if env.Proto != "" {
+		if major, minor, ok := http.ParseHTTPVersion(env.Proto); ok {
+			resp.Proto, resp.ProtoMajor, resp.ProtoMinor = env.Proto, major, minor
+		}
+	}
+	if len(env.Trailer) > 0 {
+		resp.Trailer = env.Trailer
+	}
+	if env.TLS != nil {
+		resp.TLS = env.TLS.connectionState()
+	}
+	if env.Request != nil && resp.Request != nil {
+		if req := env.Request.request(resp.Request); req != nil {
+			resp.Request = req
+		}
+	}
+}
+
+// Dump the headers and body of a request that has already been sent. The body
+// comes from GetBody, since the original has been consumed. Like the cache
+// key, large bodies are reduced to an md5.
+func newSentRequest(req *http.Request, redact []string) (*sentRequest, error) {
+	sent := &sentRequest{Method: methodOrGet(req), URL: req.URL.Redacted()}
+
+	// keys set directly on the map might not be canonical
+	clone := req.Clone(context.Background())
+	clone.Body = nil
+	for key := range clone.Header {
+		for _, name := range redact {
+			if strings.EqualFold(key, name) {
+				clone.Header[key] = []string{"[REDACTED]"}
+			}
+		}
+	}
+
+	var body io.ReadCloser
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		defer body.Close()
+	}
+	if body == nil {
+		dump, err := httputil.DumpRequest(clone, false)
+		sent.Dump = dump
+		return sent, err
+	}
+
+	// read just enough to know whether the body is short
+	prefix, err := ioutil.ReadAll(io.LimitReader(body, maxBodyKeyLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) <= maxBodyKeyLength {
+		clone.Body = ioutil.NopCloser(bytes.NewReader(prefix))
+		sent.Dump, err = httputil.DumpRequest(clone, true)
+		return sent, err
+	}
+
+	hash := md5.New()
+	hash.Write(prefix)
+	n, err := io.Copy(hash, body)
+	if err != nil {
+		return nil, err
+	}
+	sent.BodyLength = int64(len(prefix)) + n
+	sent.BodyMD5 = hex.EncodeToString(hash.Sum(nil))
+	if sent.Dump, err = httputil.DumpRequest(clone, false); err != nil {
+		return nil, err
+	}
+	sent.Dump = append(sent.Dump, fmt.Sprintf("[%d bytes, md5:%s]", sent.BodyLength, sent.BodyMD5)...)
+	return sent, nil
+}
+
+// Rebuild the sent request as a copy of base, which has the same method, URL
+// and body since it has the same cache key. Only the headers come from the
+// dump, redactions included. Returns nil if the dump can't be parsed.
+func (sent *sentRequest) request(base *http.Request) *http.Request {
+	parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(sent.Dump)))
+	if err != nil {
+		return nil
+	}
+	req := base.Clone(base.Context())
+	req.Header, req.Host = parsed.Header, parsed.Host
+	return req
+}
+
+// RequestDump returns the request that produced the cached response for req,
+// with headers and body. Headers listed in Options.RedactHeaders are redacted,
+// and bodies longer than 1024 bytes are replaced by their length and md5.
+// Returns nil if the response isn't cached, or was cached without the request,
+// and an error if the entry can't be read.
+func (hd *HTTPDisk) RequestDump(req *http.Request) ([]byte, error) {
+	cacheKey, err := hd.newCacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := hd.Cache.Get(cacheKey)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	env, _ := decodeEnvelope(data)
+	if env == nil || env.Request == nil {
+		return nil, nil
+	}
+	return env.Request.Dump, nil
+}
+
+func newTLSDetails(state *tls.ConnectionState, storeCertificates bool) *tlsDetails {
+	details := &tlsDetails{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+	for _, cert := range state.PeerCertificates {
+		sum := sha256.Sum256(cert.Raw)
+		details.Peers = append(details.Peers, peerCert{
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			NotAfter:    cert.NotAfter,
+		})
+		if storeCertificates {
+			details.Certificates = append(details.Certificates, cert.Raw)
+		}
+	}
+	return details
+}
+
+// Rebuild a ConnectionState. PeerCertificates are only restored if they were
+// stored, and certificates that can't be parsed are skipped.
+func (details *tlsDetails) connectionState() *tls.ConnectionState {
+	state := &tls.ConnectionState{
+		Version:            details.Version,
+		HandshakeComplete:  true,
+		CipherSuite:        details.CipherSuite,
+		NegotiatedProtocol: details.NegotiatedProtocol,
+		ServerName:         details.ServerName,
+	}
+	for _, der := range details.Certificates {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			state.PeerCertificates = append(state.PeerCertificates, cert)
+		}
+	}
+	return state
+}
+
+// Returns a copy of req that records the address of the server it connects
+// to in addr.
+func traceRemoteAddr(req *http.Request, addr *string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			*addr = info.Conn.RemoteAddr().String()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
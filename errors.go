@@ -0,0 +1,221 @@
+package gohttpdisk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrorCategory describes the kind of network error that was cached.
+type ErrorCategory string
+
+const (
+	CategoryDNS          ErrorCategory = "dns"
+	CategoryTimeout      ErrorCategory = "timeout"
+	CategoryRefused      ErrorCategory = "refused"
+	CategoryReset        ErrorCategory = "reset"
+	CategoryNoRoute      ErrorCategory = "no-route"
+	CategoryTLSCert      ErrorCategory = "tls-cert"
+	CategoryTLSHandshake ErrorCategory = "tls-handshake"
+	CategoryEOF          ErrorCategory = "eof"
+	CategoryCanceled     ErrorCategory = "canceled" // no longer cached, but older caches may have it
+	CategoryStream       ErrorCategory = "stream"
+	CategoryOther        ErrorCategory = "other"
+)
+
+// Sentinel errors for each category. A *CachedError unwraps to one of these,
+// so callers can use errors.Is(err, gohttpdisk.ErrNoSuchHost).
+var (
+	ErrNoSuchHost        = errors.New("no such host")
+	ErrTimeout           = errors.New("timeout")
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrConnectionReset   = errors.New("connection reset")
+	ErrNoRoute           = errors.New("no route to host")
+	ErrTLSCertificate    = errors.New("tls certificate error")
+	ErrTLSHandshake      = errors.New("tls handshake error")
+	ErrEOF               = errors.New("unexpected eof")
+	ErrCanceled          = errors.New("request canceled")
+	ErrStream            = errors.New("stream error")
+)
+
+var categorySentinels = map[ErrorCategory]error{
+	CategoryDNS:          ErrNoSuchHost,
+	CategoryTimeout:      ErrTimeout,
+	CategoryRefused:      ErrConnectionRefused,
+	CategoryReset:        ErrConnectionReset,
+	CategoryNoRoute:      ErrNoRoute,
+	CategoryTLSCert:      ErrTLSCertificate,
+	CategoryTLSHandshake: ErrTLSHandshake,
+	CategoryEOF:          ErrEOF,
+	CategoryCanceled:     ErrCanceled,
+	CategoryStream:       ErrStream,
+}
+
+// CachedError is a network error replayed from the cache.
+type CachedError struct {
+	Category ErrorCategory `json:"category"`
+	Message  string        `json:"message"`
+	Time     time.Time     `json:"time"`
+
+	// age of the cache entry
+	age time.Duration
+}
+
+func (e *CachedError) Error() string {
+	return fmt.Sprintf("%s (cached)", e.Message)
+}
+
+// Unwrap returns the sentinel error for the category, like ErrNoSuchHost.
+func (e *CachedError) Unwrap() error {
+	return categorySentinels[e.Category]
+}
+
+// ClassifyError returns the category for a cacheable network error, or "" if
+// the error shouldn't be cached. Errors are classified by type where possible,
+// falling back to the error message for errors that don't carry a type (like
+// http2 stream errors).
+func ClassifyError(err error) ErrorCategory {
+	if err == nil {
+		return ""
+	}
+
+	// The caller canceled its own request, which says nothing about the URL.
+	// net/http reports Client.Timeout and CancelRequest as "request canceled"
+	// without a type.
+	if errors.Is(err, context.Canceled) || strings.Contains(err.Error(), "request canceled") {
+		return ""
+	}
+
+	// timeouts
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) {
+		return CategoryTimeout
+	}
+
+	// dns
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		if dnsError.IsTimeout {
+			return CategoryTimeout
+		}
+		return CategoryDNS
+	}
+
+	// tls
+	var certInvalidError x509.CertificateInvalidError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	if errors.As(err, &certInvalidError) || errors.As(err, &unknownAuthorityError) || errors.As(err, &hostnameError) {
+		return CategoryTLSCert
+	}
+	var recordHeaderError tls.RecordHeaderError
+	if errors.As(err, &recordHeaderError) {
+		return CategoryTLSHandshake
+	}
+	// alerts from the server, like "tls: handshake failure"
+	var opError *net.OpError
+	if errors.As(err, &opError) && opError.Op == "remote error" {
+		return CategoryTLSHandshake
+	}
+
+	// syscalls
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CategoryRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return CategoryReset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return CategoryNoRoute
+	}
+
+	// eof
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return CategoryEOF
+	}
+
+	// other timeouts
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return CategoryTimeout
+	}
+
+	return classifyErrorMessage(err.Error())
+}
+
+// IsCacheableError is the default test for whether a network error should be
+// cached. See Options.CacheableError.
+func IsCacheableError(err error) bool {
+	return ClassifyError(err) != ""
+}
+
+// if the error message contains one of these, we consider the error to be
+// cacheable. This list was generated by hitting the tranco top 1000 websites.
+// Order matters, the first match wins.
+var cacheableErrors = []struct {
+	substring string
+	category  ErrorCategory
+}{
+	{"connection refused", CategoryRefused},
+	{"connection reset by peer", CategoryReset},
+	{"context deadline exceeded", CategoryTimeout},
+	{"i/o timeout", CategoryTimeout},
+	{"no route to host", CategoryNoRoute},
+	{"no such host", CategoryDNS},
+	{"stream error", CategoryStream},
+	{"EOF", CategoryEOF},
+}
+
+func classifyErrorMessage(message string) ErrorCategory {
+	for _, e := range cacheableErrors {
+		if strings.Contains(message, e.substring) {
+			return e.category
+		}
+	}
+	return ""
+}
+
+// Returns the category for an error that should be cached, or "" if the error
+// shouldn't be cached. Honors Options.CacheableError.
+func (hd *HTTPDisk) classifyError(err error) ErrorCategory {
+	category := ClassifyError(err)
+	if hd.Options.CacheableError != nil {
+		if !hd.Options.CacheableError(err) {
+			category = ""
+		} else if category == "" {
+			category = CategoryOther
+		}
+	}
+
+	if category == "" && hd.Options.Logger != nil {
+		hd.Options.Logger.Printf("Not caching error type:%T v:%v", err, err)
+	}
+	return category
+}
+
+// Serialize an error for the cache.
+func encodeError(err error, category ErrorCategory) []byte {
+	data, _ := json.Marshal(&CachedError{Category: category, Message: err.Error(), Time: time.Now()})
+	return append([]byte(errPrefix), data...)
+}
+
+// Deserialize a cached error. Older caches stored just the message.
+func decodeError(data []byte) *CachedError {
+	data = data[len(errPrefix):]
+	cachedError := &CachedError{}
+	if len(data) > 0 && data[0] == '{' && json.Unmarshal(data, cachedError) == nil {
+		return cachedError
+	}
+
+	cachedError = &CachedError{Category: classifyErrorMessage(string(data)), Message: string(data)}
+	if cachedError.Category == "" {
+		cachedError.Category = CategoryOther
+	}
+	return cachedError
+}
@@ -0,0 +1,132 @@
+package gohttpdisk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedErrors(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &errorRoundTripper{"dial tcp: lookup bogus.bogus: no such host"}
+
+	client := http.Client{Transport: hd}
+	url := "http://bogus.bogus"
+	client.Get(url)
+	_, err := client.Get(url)
+
+	var cachedError *CachedError
+	if assert.True(t, errors.As(err, &cachedError)) {
+		assert.Equal(t, CategoryDNS, cachedError.Category)
+		assert.Contains(t, cachedError.Message, "lookup bogus.bogus")
+		assert.False(t, cachedError.Time.IsZero())
+	}
+	assert.True(t, errors.Is(err, ErrNoSuchHost))
+	assert.False(t, errors.Is(err, ErrTimeout))
+}
+
+func TestDecodeError(t *testing.T) {
+	// legacy format
+	cachedError := decodeError([]byte("err:read tcp: i/o timeout"))
+	assert.Equal(t, CategoryTimeout, cachedError.Category)
+	assert.Equal(t, "read tcp: i/o timeout (cached)", cachedError.Error())
+
+	cachedError = decodeError([]byte("err:nope"))
+	assert.Equal(t, CategoryOther, cachedError.Category)
+	assert.Nil(t, errors.Unwrap(cachedError))
+
+	// round trip
+	cachedError = decodeError(encodeError(errors.New("connection reset by peer"), CategoryReset))
+	assert.Equal(t, CategoryReset, cachedError.Category)
+	assert.True(t, errors.Is(cachedError, ErrConnectionReset))
+}
+
+func TestClassifyError(t *testing.T) {
+	opError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://a.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}}
+	}
+
+	assert.Equal(t, CategoryDNS, ClassifyError(&net.DNSError{Err: "no such host", Name: "a.com", IsNotFound: true}))
+	assert.Equal(t, CategoryTimeout, ClassifyError(&net.DNSError{Err: "timeout", Name: "a.com", IsTimeout: true}))
+	assert.Equal(t, CategoryRefused, ClassifyError(opError(syscall.ECONNREFUSED)))
+	assert.Equal(t, CategoryReset, ClassifyError(opError(syscall.ECONNRESET)))
+	assert.Equal(t, CategoryNoRoute, ClassifyError(opError(syscall.EHOSTUNREACH)))
+	assert.Equal(t, CategoryTLSCert, ClassifyError(&url.Error{Op: "Get", URL: "https://a.com", Err: x509.UnknownAuthorityError{}}))
+	assert.Equal(t, CategoryTLSCert, ClassifyError(&url.Error{Op: "Get", URL: "https://a.com", Err: x509.HostnameError{Host: "a.com", Certificate: &x509.Certificate{}}}))
+	assert.Equal(t, CategoryTLSCert, ClassifyError(x509.CertificateInvalidError{Reason: x509.Expired}))
+	assert.Equal(t, CategoryTLSHandshake, ClassifyError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}))
+	assert.Equal(t, CategoryTLSHandshake, ClassifyError(&url.Error{Op: "Get", URL: "https://a.com", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}}))
+	assert.Equal(t, CategoryTimeout, ClassifyError(&url.Error{Op: "Get", URL: "http://a.com", Err: context.DeadlineExceeded}))
+	assert.Equal(t, CategoryEOF, ClassifyError(io.ErrUnexpectedEOF))
+
+	// fallback to messages
+	assert.Equal(t, CategoryStream, ClassifyError(errors.New("stream error: stream ID 1; INTERNAL_ERROR")))
+
+	// not cacheable
+	assert.Equal(t, ErrorCategory(""), ClassifyError(&url.Error{Op: "Get", URL: "http://a.com", Err: context.Canceled}))
+	assert.Equal(t, ErrorCategory(""), ClassifyError(&url.Error{Op: "Get", URL: "http://a.com", Err: errors.New("net/http: request canceled")}))
+	assert.Equal(t, ErrorCategory(""), ClassifyError(errors.New("remote error: tls: handshake failure")))
+	assert.Equal(t, ErrorCategory(""), ClassifyError(errors.New("boom")))
+	assert.False(t, IsCacheableError(errors.New("boom")))
+}
+
+func TestCacheableErrorOption(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), CacheableError: func(err error) bool {
+		return err.Error() == "boom" || IsCacheableError(err)
+	}})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	assert.Equal(t, CategoryOther, hd.classifyError(errors.New("boom")))
+	assert.Equal(t, CategoryDNS, hd.classifyError(errors.New("no such host")))
+	assert.Equal(t, ErrorCategory(""), hd.classifyError(errors.New("bang")))
+}
+
+func TestCanceledNotCached(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	// the first request is canceled by the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err := hd.RoundTrip(MustRequest("GET", server.URL).WithContext(ctx))
+	assert.Error(t, err)
+
+	// the next request goes to the network
+	resp, err := hd.RoundTrip(MustRequest("GET", server.URL))
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(body))
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
@@ -0,0 +1,80 @@
+package gohttpdisk
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Is this status code never cached, because of a negative StatusMaxAge or
+// because it isn't in CacheStatusCodes? Cached entries with these statuses are
+// ignored too.
+func (hd *HTTPDisk) neverCached(status int) bool {
+	if hd.Options.StatusMaxAge[status] < 0 {
+		return true
+	}
+	return len(hd.Options.CacheStatusCodes) > 0 && !containsInt(hd.Options.CacheStatusCodes, status)
+}
+
+// Is this response eligible for caching, according to the Content-Type
+// filters in Options? Cached entries that aren't are ignored too.
+func (hd *HTTPDisk) cacheableResponse(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	if matchContentType(hd.Options.NoCacheContentTypes, contentType) {
+		return false
+	}
+	if len(hd.Options.CacheContentTypes) > 0 && !matchContentType(hd.Options.CacheContentTypes, contentType) {
+		return false
+	}
+	return true
+}
+
+// Does the response announce a body larger than MaxBodySize?
+func (hd *HTTPDisk) tooBig(req *http.Request, resp *http.Response) bool {
+	return hd.Options.MaxBodySize > 0 && methodOrGet(req) != "HEAD" && resp.ContentLength > hd.Options.MaxBodySize
+}
+
+// Does the Content-Type match one of the patterns? Patterns are media types
+// like "text/html", or wildcards like "image/*". Parameters are ignored.
+func matchContentType(patterns []string, contentType string) bool {
+	if len(patterns) == 0 || contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, i := range list {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
+
+// A body that isn't being cached, like a NoStore response or one that is too
+// big. It goes straight to the caller without being buffered.
+type streamingBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Is this response being streamed rather than buffered?
+func isStreaming(resp *http.Response) bool {
+	_, ok := resp.Body.(*streamingBody)
+	return ok
+}
@@ -0,0 +1,158 @@
+package gohttpdisk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxBodySize(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxBodySize: 10})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp := newResponse(r, 200, strings.Repeat("x", len(r.URL.Path)))
+		if r.URL.Query().Get("unknown") != "" {
+			resp.ContentLength = -1
+		}
+		return resp, nil
+	})
+
+	tests := []struct {
+		url    string
+		cached bool
+	}{
+		{"http://example.com/small", true},
+		{"http://example.com/this-is-too-big", false},
+		{"http://example.com/this-is-too-big?unknown=1", false},
+	}
+	for _, tt := range tests {
+		req := MustRequest("GET", tt.url)
+		resp, err := hd.RoundTrip(req)
+		if assert.NoError(t, err, tt.url) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, len(req.URL.Path), len(body), tt.url)
+		}
+		data, _, _ := hd.Cache.Get(MustCacheKey(req))
+		assert.Equal(t, tt.cached, len(data) > 0, tt.url)
+	}
+}
+
+func TestCacheableResponse(t *testing.T) {
+	hd := NewHTTPDisk(Options{
+		CacheContentTypes:   []string{"text/*", "application/json"},
+		NoCacheContentTypes: []string{"text/csv"},
+	})
+
+	tests := []struct {
+		contentType string
+		cacheable   bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"TEXT/PLAIN", true},
+		{"text/csv", false},
+		{"video/mp4", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		resp := newResponse(MustRequest("GET", "http://example.com"), 200, "", "Content-Type", tt.contentType)
+		assert.Equal(t, tt.cacheable, hd.cacheableResponse(resp), tt.contentType)
+	}
+}
+
+func TestCacheStatusCodes(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{StatusCode: 403}
+	hd.Transport = transport
+	hd.RoundTrip(MustRequest("GET", "http://example.com"))
+
+	// like a negative StatusMaxAge, existing entries are ignored too
+	hd = NewHTTPDisk(Options{Dir: hd.Options.Dir, CacheStatusCodes: []int{200, 404}, StatusMaxAge: map[int]time.Duration{404: -1}})
+	hd.Transport = transport
+	assert.False(t, hd.neverCached(200))
+	assert.True(t, hd.neverCached(403))
+	assert.True(t, hd.neverCached(404))
+
+	resp, err := hd.RoundTrip(MustRequest("GET", "http://example.com"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+	assert.Equal(t, 2, transport.Count())
+}
+
+func TestContentTypeNotCached(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), NoCacheContentTypes: []string{"video/*"}})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return newResponse(r, 200, "movie", "Content-Type", "video/mp4"), nil
+	})
+
+	req := MustRequest("GET", "http://example.com/movie.mp4")
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "movie", string(body))
+	}
+	data, _, _ := hd.Cache.Get(MustCacheKey(req))
+	assert.Empty(t, data)
+
+	// existing entries are ignored too
+	transport := &counterRoundTripper{Header: http.Header{"Content-Type": {"video/mp4"}}}
+	hd = NewHTTPDisk(Options{Dir: hd.Options.Dir})
+	hd.Transport = transport
+	hd.RoundTrip(req)
+	hd = NewHTTPDisk(Options{Dir: hd.Options.Dir, CacheContentTypes: []string{"text/*"}})
+	hd.Transport = transport
+	resp, err = hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+	assert.Equal(t, 2, transport.Count())
+}
+
+func TestUncachedResponseStreams(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		fmt.Fprint(w, "start ")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "end")
+	}))
+	defer server.Close()
+
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), NoCacheContentTypes: []string{"video/*"}})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	// RoundTrip returns before the body is finished
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := hd.RoundTrip(MustRequest("GET", server.URL))
+		assert.NoError(t, err)
+		done <- resp
+	}()
+	var resp *http.Response
+	select {
+	case resp = <-done:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("RoundTrip buffered the body")
+	}
+	close(release)
+
+	if resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "start end", string(body))
+	}
+}
@@ -0,0 +1,95 @@
+package gohttpdisk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// flightGroup coalesces concurrent fetches for the same key, so that only one
+// network request is made. Every caller gets its own copy of the response.
+// Only responses that are being cached are shared, since those are buffered
+// anyway. The zero value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// a fetch in progress
+type flight struct {
+	done        chan struct{}
+	resp        *http.Response
+	body        []byte
+	revalidated bool
+	streaming   bool
+	err         error
+	// the leader's error came from its own context, not from the fetch, or fn
+	// panicked
+	canceled bool
+}
+
+// Run fn, unless a call with the same key is already in progress. In that case
+// wait for it and return a copy of its result. Streaming responses, which
+// aren't being cached, go to the first caller only and the others run fn
+// themselves, as they do if the first caller's context was canceled. Waiting
+// stops early if ctx is done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (*http.Response, bool, error)) (*http.Response, bool, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if f.streaming || f.canceled {
+			return fn()
+		}
+		return f.result()
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	// if fn panics, let the waiters try for themselves rather than leaving them
+	// stuck
+	f.canceled = true
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.resp, f.revalidated, f.err = fn()
+	f.streaming = f.err == nil && isStreaming(f.resp)
+	if f.err == nil && !f.streaming {
+		// buffer the body so it can be handed out more than once
+		f.body, f.err = ioutil.ReadAll(f.resp.Body)
+		f.resp.Body.Close()
+	}
+	f.canceled = f.err != nil && ctx.Err() != nil
+
+	if f.streaming {
+		return f.resp, f.revalidated, nil
+	}
+	return f.result()
+}
+
+// Returns an independent copy of the response, with its own body.
+func (f *flight) result() (*http.Response, bool, error) {
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	resp := new(http.Response)
+	*resp = *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Trailer = f.resp.Trailer.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	return resp, f.revalidated, nil
+}
@@ -0,0 +1,210 @@
+package gohttpdisk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroup(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{}
+	hd.Transport = &slowRoundTripper{transport, 100 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 50)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+			if err != nil {
+				t.Errorf("RoundTrip failed %s", err)
+				return
+			}
+			data, _ := ioutil.ReadAll(resp.Body)
+			bodies[i] = string(data)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, transport.Count())
+	for _, body := range bodies {
+		assert.Equal(t, "body 1", body)
+	}
+}
+
+func TestFlightGroupNoStore(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{}
+	hd.Transport = &slowRoundTripper{transport, 50 * time.Millisecond}
+
+	// responses that aren't cached aren't shared either
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := MustRequest("GET", "http://httpbingo.org/get")
+			req = req.WithContext(WithRequestOptions(req.Context(), RequestOptions{NoStore: true}))
+			resp, err := hd.RoundTrip(req)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, transport.Count())
+}
+
+func TestFlightGroupCanceledLeader(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{}
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return transport.RoundTrip(r)
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	})
+	url := "http://httpbingo.org/get"
+
+	// the leader gives up, the waiter fetches for itself
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := hd.RoundTrip(MustRequest("GET", url).WithContext(ctx))
+		assert.Error(t, err)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	resp, err := hd.RoundTrip(MustRequest("GET", url))
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "body 1", string(data))
+	}
+	wg.Wait()
+}
+
+func TestFlightGroupWaiterContext(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &slowRoundTripper{&counterRoundTripper{}, 200 * time.Millisecond}
+	url := "http://httpbingo.org/get"
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hd.RoundTrip(MustRequest("GET", url))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// the waiter doesn't wait longer than its own context allows
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := hd.RoundTrip(MustRequest("GET", url).WithContext(ctx))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	wg.Wait()
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.do(context.Background(), "key", func() (*http.Response, bool, error) {
+			close(started)
+			time.Sleep(20 * time.Millisecond)
+			panic("boom")
+		})
+	}()
+	<-started
+
+	// the waiter isn't stuck, and runs fn itself
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, _, err := g.do(ctx, "key", func() (*http.Response, bool, error) {
+		return newResponse(nil, 200, "ok"), false, nil
+	})
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(data))
+	}
+}
+
+func TestFlightGroupCanceledBody(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		g.do(ctx, "key", func() (*http.Response, bool, error) {
+			close(started)
+			// the body fails because the leader gives up while it is read
+			resp := newResponse(nil, 200, "")
+			resp.Body = ioutil.NopCloser(iotest.ErrReader(context.Canceled))
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+			return resp, false, nil
+		})
+	}()
+	<-started
+
+	resp, _, err := g.do(context.Background(), "key", func() (*http.Response, bool, error) {
+		return newResponse(nil, 200, "ok"), false, nil
+	})
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "ok", string(data))
+	}
+}
+
+func TestFlightKey(t *testing.T) {
+	req := MustRequest("GET", "http://httpbingo.org/get")
+	cacheKey := MustCacheKey(req)
+	key := flightKey(req, cacheKey, fetchOptions{store: true})
+	assert.Equal(t, key, flightKey(req, cacheKey, fetchOptions{store: true}))
+
+	// fetches with different options aren't shared
+	assert.NotEqual(t, key, flightKey(req, cacheKey, fetchOptions{}))
+	assert.NotEqual(t, key, flightKey(req, cacheKey, fetchOptions{store: true, cacheErrors: true}))
+	assert.NotEqual(t, key, flightKey(req, cacheKey, fetchOptions{store: true, validators: &validators{}}))
+
+	req.Header.Set("Range", "bytes=0-9")
+	assert.NotEqual(t, key, flightKey(req, cacheKey, fetchOptions{store: true}))
+}
+
+//
+// RoundTripper that waits before delegating
+//
+
+type slowRoundTripper struct {
+	transport http.RoundTripper
+	delay     time.Duration
+}
+
+func (t *slowRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	time.Sleep(t.delay)
+	return t.transport.RoundTrip(r)
+}
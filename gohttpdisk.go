@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +24,20 @@ type HTTPDisk struct {
 	// if nil, http.DefaultTransport is used.
 	Transport http.RoundTripper
 	Options   Options
+
+	// concurrent fetches for the same key
+	inflight flightGroup
+
+	// background revalidation
+	revalidator revalidator
+
+	// per-host rate limiting
+	limiter limiter
+
+	// parsed robots.txt for each host
+	robotsCache robotsCache
+
+	stats stats
 }
 
 // Options for creating a new HTTPDisk.
@@ -28,11 +45,56 @@ type Options struct {
 	// Directory where the cache is stored. Defaults to httpdisk.
 	Dir string
 
+	// Caching mode, either ModeAggressive (the default) or ModeRFC.
+	Mode Mode
+
 	// Maximum amount of time a cached response is considered fresh. If less
 	// than or equal to zero, then all content is considered fresh. If positive,
-	// then cached content will be re-fetched if it is older than this.
+	// then cached content will be re-fetched if it is older than this. Re-fetches
+	// use ETag and Last-Modified from the stale response when present, so an
+	// unchanged body isn't downloaded again.
 	MaxAge time.Duration
 
+	// Maximum age for cached network errors, like "no such host". Defaults to
+	// MaxAge.
+	ErrorMaxAge time.Duration
+
+	// Maximum age for cached 4xx responses. Defaults to MaxAge.
+	ClientErrorMaxAge time.Duration
+
+	// Maximum age for cached 5xx responses. Defaults to MaxAge.
+	ServerErrorMaxAge time.Duration
+
+	// Maximum age for specific status codes, like 404 or 429. Takes precedence
+	// over ClientErrorMaxAge and ServerErrorMaxAge. A negative value means
+	// responses with that status are never cached.
+	StatusMaxAge map[int]time.Duration
+
+	// Responses with bodies larger than this many bytes aren't cached. Like
+	// every response that isn't cached, they are streamed to the caller without
+	// being buffered in memory. Zero means no limit.
+	MaxBodySize int64
+
+	// If set, only responses with these Content-Types are cached. Entries are
+	// media types like "text/html", or wildcards like "image/*". Existing
+	// entries with other Content-Types are ignored too.
+	CacheContentTypes []string
+
+	// Responses with these Content-Types are never cached, and existing
+	// entries are ignored. Takes precedence over CacheContentTypes.
+	NoCacheContentTypes []string
+
+	// If set, only responses with these status codes are cached. Any other
+	// status is treated like a negative StatusMaxAge, so it is never cached. To
+	// exclude just a few status codes, use a negative StatusMaxAge instead.
+	CacheStatusCodes []int
+
+	// Bodies are always stored decoded, with Content-Length to match. If true,
+	// cached responses are returned gzip-encoded with "Content-Encoding: gzip"
+	// instead of decoded. Range responses and responses that aren't cached are
+	// returned as they are.
+	GzipResponses bool
+
 	// Don't read anything from cache (but still write)
 	Force bool
 
@@ -42,17 +104,92 @@ type Options struct {
 	// Optional logger
 	Logger *log.Logger
 
+	// Optional test for whether a network error should be cached. Defaults to
+	// IsCacheableError. To extend the default, call IsCacheableError from your
+	// own function.
+	CacheableError func(err error) bool
+
 	// Don't cache errors during background revalidation. Leave stale data in cache instead.
 	// Only relevant if StaleWhileRevalidate is set.
 	NoCacheRevalidationErrors bool
 
+	// Answer HEAD requests from cached GET responses (headers only), fresh or
+	// stale as a GET would be. HEAD responses aren't stored separately when a
+	// GET is cached.
+	HeadFromGet bool
+
 	// If true, don't include the request hostname in the path for each element.
 	NoHosts bool
 
+	// Partition the cache by the values of these cookies, typically session
+	// cookies set by a cookie jar. Requests without any of these cookies are not
+	// partitioned. A partition set with WithPartition takes precedence.
+	PartitionCookies []string
+
+	// Number of concurrent background revalidations. Defaults to 4. Only
+	// relevant if StaleWhileRevalidate is set.
+	RevalidationWorkers int
+
+	// Number of background revalidations that can be queued. If the queue is
+	// full, the revalidation is dropped and the stale entry stays in place until
+	// it is requested again. Defaults to 100.
+	RevalidationQueueSize int
+
 	// If StaleWhileRevalidate is enabled, you may optionally set this wait group
 	// to be notified when background fetches complete.
+	//
+	// Deprecated: use HTTPDisk.Flush instead.
 	RevalidationWaitGroup *sync.WaitGroup
 
+	// Request headers whose values are replaced with "[REDACTED]" when the
+	// request is stored alongside its response. Defaults to Authorization,
+	// Cookie and Proxy-Authorization. Set to an empty slice to store everything.
+	RedactHeaders []string
+
+	// Store the peer certificate chain with each response, so that
+	// resp.TLS.PeerCertificates is restored on hits. Otherwise only the
+	// fingerprint, subject, issuer and expiry of each certificate are stored.
+	StoreCertificates bool
+
+	// Rules that apply a different Policy to matching requests, like a shorter
+	// MaxAge for a news site or Bypass for /login. The first matching Rule wins.
+	// Anything its Policy leaves unset is inherited from these Options.
+	Rules []Rule
+
+	// If positive, serve a stale cached response when a refresh fails with a
+	// network error or a 5xx, as long as it has been stale for less than this
+	// long. The stale response stays in the cache. Only relevant if MaxAge is set.
+	StaleIfError time.Duration
+
+	// If set, honor robots.txt for this user agent. URLs that aren't allowed
+	// fail with ErrDisallowedByRobots. robots.txt is cached for up to a day,
+	// regardless of MaxAge and Force, and server errors for it aren't cached.
+	// Crawl-delay feeds into RateLimit if one is configured.
+	RobotsUserAgent string
+
+	// Optional per-host rate limiting for network requests.
+	RateLimit *RateLimit
+
+	// Optional policy for retrying transient network errors and status codes.
+	// Errors are only cached once the retries are exhausted.
+	Retry *RetryPolicy
+
+	// When a 429 or 503 has a Retry-After, wait and retry up to this many times
+	// before giving up. Defaults to 0, which means the response is returned
+	// (and cached until the Retry-After time) without waiting.
+	RetryAfterRetries int
+
+	// Maximum time to wait for a single Retry-After. Longer waits are not
+	// attempted. Defaults to one minute.
+	RetryAfterMaxWait time.Duration
+
+	// Save bodies on disk as they arrive, and if a download fails resume it
+	// with a Range request next time. Only responses with a strong ETag, or a
+	// Last-Modified at least a second older than Date, can be resumed. The
+	// response is cached once the whole body has arrived and matches
+	// Content-Length.
+	ResumeDownloads bool
+
 	// Return stale cached responses while refreshing the cache in the background.
 	// Only relevant if MaxAge is set.
 	StaleWhileRevalidate bool
@@ -64,12 +201,16 @@ type Options struct {
 }
 
 type Status struct {
-	Age    time.Duration
-	Digest string
-	Key    string
-	Path   string
-	Status string
-	URL    string
+	Age       time.Duration
+	Digest    string
+	Key       string
+	Partition string
+	Path      string
+	Redirects *RedirectChain
+	// address of the server that sent the cached response, if known
+	RemoteAddr string
+	Status     string
+	URL        string
 }
 
 type CacheEntry struct {
@@ -79,13 +220,31 @@ type CacheEntry struct {
 
 const errPrefix = "err:"
 
+// Values for the X-Gohttpdisk-Status header, which is set on every response
+// returned by RoundTrip.
+const (
+	// Fresh response from the cache
+	StatusHit = "hit"
+	// Response fetched from the network
+	StatusMiss = "miss"
+	// Stale response from the cache, possibly being revalidated in the background
+	StatusStale = "stale"
+	// Stale response from the cache that was revalidated with the server
+	StatusRevalidated = "revalidated"
+	// Cached http error (status >= 400) from the cache
+	StatusError = "error"
+)
+
+// ErrCacheMiss is returned for CacheOnly requests that aren't in the cache.
+var ErrCacheMiss = errors.New("not in cache")
+
 // NewHTTPDisk constructs a new HTTPDisk.
 func NewHTTPDisk(options Options) *HTTPDisk {
 	return &HTTPDisk{Cache: *newCache(options), Options: options}
 }
 
 func (hd *HTTPDisk) Status(req *http.Request) (*Status, error) {
-	cacheKey, err := NewCacheKey(req)
+	cacheKey, err := hd.newCacheKey(req)
 	if err != nil {
 		return nil, err
 	}
@@ -101,45 +260,105 @@ func (hd *HTTPDisk) Status(req *http.Request) (*Status, error) {
 		status = "hit"
 	}
 
+	redirects, err := hd.Redirects(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteAddr string
+	if env, _ := decodeEnvelope(data); env != nil {
+		remoteAddr = env.RemoteAddr
+	}
+
 	return &Status{
-		Age:    age,
-		Digest: cacheKey.Digest(),
-		Key:    cacheKey.Key(),
-		Path:   hd.Cache.diskpath(cacheKey),
-		Status: status,
-		URL:    req.URL.String(),
+		Age:        age,
+		Digest:     cacheKey.Digest(),
+		Key:        cacheKey.Key(),
+		Partition:  cacheKey.Partition,
+		Path:       hd.Cache.diskpath(cacheKey),
+		Redirects:  redirects,
+		RemoteAddr: remoteAddr,
+		Status:     status,
+		URL:        req.URL.String(),
 	}, nil
 }
 
-func (hd *HTTPDisk) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	cacheKey, err := NewCacheKey(req)
+func (hd *HTTPDisk) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := hd.roundTripCached(req)
+	if err != nil || !hd.Options.GzipResponses {
+		return resp, err
+	}
+	return gzipResponse(req, resp)
+}
+
+// The guts of RoundTrip. Bodies are always decoded here.
+func (hd *HTTPDisk) roundTripCached(req *http.Request) (resp *http.Response, err error) {
+	cacheKey, err := hd.newCacheKey(req)
 	if err != nil {
 		return nil, err
 	}
+	settings := hd.settings(req)
+
+	// If this request is the end of a redirect chain, remember the chain
+	if req.Response != nil && !settings.noStore {
+		defer func() {
+			if err != nil {
+				return
+			}
+			if err := hd.recordRedirects(req, resp); err != nil && hd.Options.Logger != nil {
+				hd.Options.Logger.Printf("Failed to record redirects for %s (%s)", req.URL, err)
+			}
+		}()
+	}
 
 	//
 	// Try to read response from cache
 	//
 
-	entry, err := hd.get(cacheKey)
-	if err != nil {
-		return nil, err
+	// A HEAD can be answered from a cached GET. In that case a separately
+	// stored HEAD is never used, and the GET's key is used to revalidate.
+	var entry *CacheEntry
+	var getKey *CacheKey
+	if hd.Options.HeadFromGet && req.Method == "HEAD" {
+		entry, getKey = hd.headFromGet(req, settings)
+	}
+	if entry == nil {
+		entry, err = hd.get(cacheKey, settings)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	var status string
+	var stale *CacheEntry
 	if entry != nil {
 		resp = entry.Response
+		status = StatusHit
+		if isHttpError(resp) {
+			status = StatusError
+		}
 	}
 
 	//
 	// Handle stale responses
 	//
 
-	if hd.isStale(entry) {
-		if hd.Options.StaleWhileRevalidate {
+	if entry != nil && hd.isStale(entry, settings) {
+		if settings.cacheOnly {
+			// Return stale data, we can't use the network.
+			status = StatusStale
+		} else if settings.staleWhileRevalidate && hd.allowsStale(entry) {
 			// Revalidate in the background while returning stale data.
-			hd.backgroundRevalidate(req, cacheKey)
+			if getKey != nil {
+				hd.backgroundRevalidate(getKey.Request, getKey, entry, settings)
+			} else {
+				hd.backgroundRevalidate(cacheKey.Request, cacheKey, entry, settings)
+			}
+			status = StatusStale
 		} else {
-			// Must fetch and return fresh data. Drop the stale data.
+			// Must fetch and return fresh data. Drop the stale data, but try to
+			// revalidate it with a conditional request.
+			stale = entry
 			resp = nil
 		}
 	}
@@ -149,64 +368,321 @@ func (hd *HTTPDisk) RoundTrip(req *http.Request) (resp *http.Response, err error
 	//
 
 	if resp == nil {
-		// not found. make the request.
-		resp, err = hd.fetch(req, cacheKey, true)
+		if settings.cacheOnly {
+			return nil, fmt.Errorf("%w (%s)", ErrCacheMiss, req.URL.String())
+		}
+		if hd.Options.RobotsUserAgent != "" {
+			if err := hd.checkRobots(req); err != nil {
+				return nil, err
+			}
+		}
+
+		opts := fetchOptions{store: !settings.noStore, cacheErrors: settings.cacheErrors, cacheHTTPErrors: settings.cacheHTTPErrors}
+		if stale != nil {
+			opts.validators = newValidators(stale.Response)
+			opts.keepStale = hd.allowsStaleIfError(stale, settings)
+		}
+		if getKey != nil {
+			// the GET is stale. fetch HEAD, but don't store it separately, and
+			// don't revalidate the GET with it.
+			opts.store, opts.validators = false, nil
+		}
+
+		// not found. make the request, unless an identical request is already
+		// in progress.
+		var revalidated bool
+		// cacheKey.Request is req, or a copy of it with a body that can be resent
+		resp, revalidated, err = hd.inflight.do(req.Context(), flightKey(req, cacheKey, opts), func() (*http.Response, bool, error) {
+			return hd.fetch(cacheKey.Request, cacheKey, opts)
+		})
+
+		// refresh failed, fall back to the stale response
+		if opts.keepStale && (err != nil || isServerError(resp)) {
+			if hd.Options.Logger != nil {
+				hd.Options.Logger.Printf("Serving stale %s after refresh failed", req.URL)
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			resp, err = serveRange(req, stale.Response)
+			if err != nil {
+				return nil, err
+			}
+			resp.Header.Set("Warning", `111 - "Revalidation Failed"`)
+			hd.setStatusHeaders(resp, StatusStale, stale)
+			return resp, nil
+		}
+
 		if err != nil {
 			return nil, err
 		}
+		resp.Request = req
+		if isRedirect(resp) {
+			// cacheKey.Request has a body that can be read again, see
+			// recordRedirects
+			resp.Request = cacheKey.Request
+		}
+		if revalidated {
+			// the full response came from the cache
+			resp, err = serveRange(req, resp)
+			if err != nil {
+				return nil, err
+			}
+			hd.setStatusHeaders(resp, StatusRevalidated, &CacheEntry{Response: resp})
+		} else {
+			hd.setStatusHeaders(resp, StatusMiss, nil)
+		}
+		return resp, nil
 	}
 
+	resp, err = serveRange(req, resp)
+	if err != nil {
+		return nil, err
+	}
+	hd.setStatusHeaders(resp, status, entry)
 	return resp, nil
 }
 
-// Fetch a response over the network
-func (hd *HTTPDisk) fetch(req *http.Request, cacheKey *CacheKey, cacheErrors bool) (resp *http.Response, err error) {
+// settings are the effective options for a single request, after applying
+// per-request overrides.
+type settings struct {
+	cacheErrors          bool
+	cacheHTTPErrors      bool
+	cacheOnly            bool
+	force                bool
+	forceErrors          bool
+	maxAge               time.Duration
+	noStore              bool
+	staleIfError         time.Duration
+	staleWhileRevalidate bool
+}
+
+// Calculate the effective settings for a request.
+func (hd *HTTPDisk) settings(req *http.Request) *settings {
+	settings := &settings{
+		cacheErrors:          true,
+		cacheHTTPErrors:      true,
+		force:                hd.Options.Force,
+		forceErrors:          hd.Options.ForceErrors,
+		maxAge:               hd.Options.MaxAge,
+		staleIfError:         hd.Options.StaleIfError,
+		staleWhileRevalidate: hd.Options.StaleWhileRevalidate,
+	}
+
+	if policy := matchRules(hd.Options.Rules, req); policy != nil {
+		if policy.MaxAge != 0 {
+			settings.maxAge = policy.MaxAge
+		}
+		if policy.StaleIfError != 0 {
+			settings.staleIfError = policy.StaleIfError
+		}
+		if policy.StaleWhileRevalidate {
+			settings.staleWhileRevalidate = true
+		}
+		if policy.NoStaleWhileRevalidate {
+			settings.staleWhileRevalidate = false
+		}
+		if policy.NoCacheErrors {
+			settings.cacheErrors = false
+			settings.cacheHTTPErrors = false
+			settings.forceErrors = true
+		}
+		if policy.Bypass {
+			settings.force = true
+			settings.noStore = true
+		}
+	}
+
+	if hd.Options.Mode == ModeRFC {
+		settings.applyRFC(req)
+	}
+
+	if ro, ok := RequestOptionsFromContext(req.Context()); ok {
+		settings.force = settings.force || ro.Force || ro.Bypass
+		settings.forceErrors = settings.forceErrors || ro.ForceErrors
+		settings.noStore = settings.noStore || ro.NoStore || ro.Bypass
+		settings.cacheOnly = ro.CacheOnly
+		if ro.MaxAge > 0 {
+			settings.maxAge = ro.MaxAge
+		}
+	}
+
+	// CacheOnly can't use the network, so the cache has to be read even if
+	// Force or a Bypass rule would skip it
+	if settings.cacheOnly {
+		settings.force = false
+	}
+
+	return settings
+}
+
+// Create the cache key for a request, partitioning by cookies if configured.
+func (hd *HTTPDisk) newCacheKey(req *http.Request) (*CacheKey, error) {
+	cacheKey, err := NewCacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+	if cacheKey.Partition == "" && len(hd.Options.PartitionCookies) > 0 {
+		cacheKey.Partition = cookiePartition(req, hd.Options.PartitionCookies)
+	}
+	return cacheKey, nil
+}
+
+// Requests with the same digest in the same partition share a fetch, as long
+// as they fetch the same way. A waiter would otherwise get a response that was
+// fetched with the leader's options. Different ranges of the same resource
+// can't share a fetch either.
+func flightKey(req *http.Request, cacheKey *CacheKey, opts fetchOptions) string {
+	key := fmt.Sprintf("%s/%s %t %t %t %t %t", cacheKey.Partition, cacheKey.Digest(), opts.store, opts.cacheErrors, opts.cacheHTTPErrors, opts.keepStale, opts.validators != nil)
+	if isRangeRequest(req) {
+		key += " " + req.Header.Get("Range")
+	}
+	return key
+}
+
+// Options for a single fetch.
+type fetchOptions struct {
+	// Store the response in the cache
+	store bool
+	// Store network errors in the cache
+	cacheErrors bool
+	// Store http errors (4xx and 5xx responses) in the cache
+	cacheHTTPErrors bool
+	// Never overwrite the cached entry with a network error or 5xx
+	keepStale bool
+	// Validators from the stale entry, for making a conditional request
+	validators *validators
+}
+
+// Fetch a response over the network, and store it in the cache if
+// opts.store is set. If opts.validators are provided the request is made
+// conditional, and a 304 refreshes the stale cached response instead. In that
+// case revalidated will be true.
+func (hd *HTTPDisk) fetch(req *http.Request, cacheKey *CacheKey, opts fetchOptions) (resp *http.Response, revalidated bool, err error) {
 	transport := hd.Transport
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
 
+	origReq, conditional := req, false
+	if opts.validators != nil {
+		req, conditional = opts.validators.apply(req)
+	}
+
+	// pick up a failed download where it left off
+	var partial *partialDownload
+	if hd.Options.ResumeDownloads && opts.store && !conditional && req.Header.Get("Range") == "" {
+		if partial = hd.loadPartial(cacheKey); partial != nil {
+			req = partial.apply(req)
+		}
+	}
+
 	// not found. make the request
 	if hd.Options.Logger != nil {
 		hd.Options.Logger.Printf("%s %s", req.Method, req.URL)
 	}
 
 	start := time.Now()
-	resp, err = transport.RoundTrip(req)
+	var remoteAddr string
+	resp, err = hd.roundTrip(transport, traceRemoteAddr(req, &remoteAddr))
 	if err != nil {
 		if hd.Options.Logger != nil {
 			hd.Options.Logger.Printf("Network error on %s (%s)", req.URL, err)
 		}
 
-		if cacheErrors {
+		if opts.store && opts.cacheErrors && !opts.keepStale {
 			err = hd.handleError(cacheKey, err)
 		}
-		return nil, err
+		return nil, false, err
+	}
+
+	if partial != nil {
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if resumed := partial.resume(resp); resumed != nil {
+				resp = resumed
+				break
+			}
+			// the pieces don't line up, start over
+			discard(resp)
+			hd.Cache.RemoveMeta(cacheKey, partialMeta)
+			return hd.fetch(origReq, cacheKey, opts)
+		case http.StatusRequestedRangeNotSatisfiable:
+			discard(resp)
+			hd.Cache.RemoveMeta(cacheKey, partialMeta)
+			return hd.fetch(origReq, cacheKey, opts)
+		case http.StatusOK:
+			// the body changed, or the server ignores Range
+			hd.Cache.RemoveMeta(cacheKey, partialMeta)
+		}
+	}
+
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp, err = hd.notModified(cacheKey, resp, start, remoteAddr, opts.store)
+		if resp == nil && err == nil {
+			// cached response is gone, try again without validators
+			opts.validators = nil
+			opts.keepStale = false
+			return hd.fetch(origReq, cacheKey, opts)
+		}
+		return resp, err == nil, err
 	}
 
 	if hd.Options.Logger != nil && isHttpError(resp) {
 		hd.Options.Logger.Printf("Http error on %s (%s)", req.URL, resp.Status)
 	}
 
+	store := opts.store
+	if store && hd.Options.Mode == ModeRFC && !rfcStorable(req, resp) {
+		store = false
+	}
+	if store && opts.keepStale && isServerError(resp) {
+		store = false
+	}
+	if store && hd.neverCached(resp.StatusCode) {
+		store = false
+	}
+	if store && resp.StatusCode == http.StatusPartialContent {
+		// never store part of a body under the key for the whole thing
+		store = false
+	}
+	if store && !hd.cacheableResponse(resp) {
+		store = false
+	}
+	if store && hd.tooBig(req, resp) {
+		if hd.Options.Logger != nil {
+			hd.Options.Logger.Printf("Not caching %s (%d bytes is larger than MaxBodySize)", req.URL, resp.ContentLength)
+		}
+		store = false
+	}
+	if !store {
+		if partial, ok := resp.Body.(*partialBody); ok {
+			// resumed, but it won't be cached after all
+			partial.stop()
+		}
+		// hand the body to the caller as it arrives
+		resp.Body = &streamingBody{resp.Body, resp.Body}
+		return resp, false, nil
+	}
+
 	// cache response
-	err = hd.set(cacheKey, resp, start, cacheErrors)
+	err = hd.set(cacheKey, resp, start, remoteAddr, opts)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return resp, nil
+	return resp, false, nil
 }
 
-// Launch goroutine to refresh the cache
-func (hd *HTTPDisk) backgroundRevalidate(req *http.Request, cacheKey *CacheKey) {
-	// If configured, update timestamp on old file before proceeding. Protection
-	// against thundering herd.
-	if hd.Options.TouchBeforeRevalidate {
-		hd.Cache.Touch(cacheKey)
-	}
-
-	if hd.Options.RevalidationWaitGroup != nil {
-		hd.Options.RevalidationWaitGroup.Add(1)
+// Queue a background refresh of the cache
+func (hd *HTTPDisk) backgroundRevalidate(req *http.Request, cacheKey *CacheKey, stale *CacheEntry, settings *settings) {
+	// Grab validators now, before the stale response is handed to the caller
+	opts := fetchOptions{
+		store:           !settings.noStore,
+		cacheErrors:     settings.cacheErrors && !hd.Options.NoCacheRevalidationErrors,
+		cacheHTTPErrors: settings.cacheHTTPErrors && !hd.Options.NoCacheRevalidationErrors,
+		keepStale:       hd.allowsStaleIfError(stale, settings),
+		validators:      newValidators(stale.Response),
 	}
 
 	// Clone the request so that we can reissue it without being tied
@@ -214,30 +690,84 @@ func (hd *HTTPDisk) backgroundRevalidate(req *http.Request, cacheKey *CacheKey)
 	// when the main thread returns.
 	req = req.Clone(context.Background())
 
-	// Perform fetch in goroutine
-	go func() {
+	// Refresh the whole response, not just the range that was requested
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	if hd.Options.RevalidationWaitGroup != nil {
+		hd.Options.RevalidationWaitGroup.Add(1)
+	}
+	// share the fetch with a foreground request for the same key, if any
+	key := flightKey(req, cacheKey, opts)
+	hd.revalidator.start(hd.Options.RevalidationWorkers, hd.Options.RevalidationQueueSize)
+	err := hd.revalidator.enqueue(key, func() {
 		if hd.Options.RevalidationWaitGroup != nil {
 			defer hd.Options.RevalidationWaitGroup.Done()
 		}
-		hd.fetch(req, cacheKey, !hd.Options.NoCacheRevalidationErrors)
-	}()
+		resp, _, err := hd.inflight.do(req.Context(), key, func() (*http.Response, bool, error) {
+			return hd.fetch(req, cacheKey, opts)
+		})
+		if err == nil {
+			resp.Body.Close()
+		}
+	})
+	if err != nil {
+		if hd.Options.RevalidationWaitGroup != nil {
+			hd.Options.RevalidationWaitGroup.Done()
+		}
+		if hd.Options.Logger != nil && err == errRevalidationQueueFull {
+			hd.Options.Logger.Printf("Dropped revalidation of %s (%s)", req.URL, err)
+		}
+		return
+	}
+
+	// If configured, update timestamp on old file now that a refresh is on the
+	// way. Protection against thundering herd.
+	if hd.Options.TouchBeforeRevalidate {
+		hd.Cache.Touch(cacheKey)
+	}
+}
+
+// Flush waits for queued background revalidations to finish.
+func (hd *HTTPDisk) Flush(ctx context.Context) error {
+	return hd.revalidator.flush(ctx)
+}
+
+// Close stops accepting background revalidations and waits for queued ones to
+// finish. Stale responses are still served after Close, but they are no longer
+// revalidated.
+func (hd *HTTPDisk) Close(ctx context.Context) error {
+	return hd.revalidator.close(ctx)
 }
 
 // Get cached response for this request. Honors Force and ForceErrors
 // but may return stale data.
-func (hd *HTTPDisk) get(cacheKey *CacheKey) (*CacheEntry, error) {
-	if hd.Options.Force {
+func (hd *HTTPDisk) get(cacheKey *CacheKey, settings *settings) (*CacheEntry, error) {
+	if settings.force {
 		// Ignore cached data if Force is on
 		return nil, nil
 	}
 
 	entry, err := hd.readFromCache(cacheKey)
 
+	//
+	// Drop errors that have expired, and statuses or Content-Types that are
+	// never cached
+	//
+
+	var cachedError *CachedError
+	if errors.As(err, &cachedError) && hd.isExpiredError(cachedError, settings) {
+		err = nil
+	}
+	if entry != nil && (hd.neverCached(entry.Response.StatusCode) || !hd.cacheableResponse(entry.Response)) {
+		entry = nil
+	}
+
 	//
 	// If ForceErrors is on, drop all cached errors
 	//
 
-	if hd.Options.ForceErrors {
+	if settings.forceErrors {
 		// Drop cached network errors
 		err = nil
 
@@ -260,36 +790,99 @@ func (hd *HTTPDisk) readFromCache(cacheKey *CacheKey) (*CacheEntry, error) {
 		return nil, err
 	}
 
-	// is it a cached error?
+	// is it a cached error? RFC mode never caches those, so ignore any left
+	// over from aggressive mode.
 	if bytes.HasPrefix(data, []byte(errPrefix)) {
-		errString := string(data[len(errPrefix):])
-		return nil, fmt.Errorf("%s (cached)", errString)
+		if hd.Options.Mode == ModeRFC {
+			return nil, nil
+		}
+		cachedError := decodeError(data)
+		cachedError.age = age
+		return nil, cachedError
 	}
 
+	env, data := decodeEnvelope(data)
 	buf := bytes.NewBuffer(data)
 	resp, err := http.ReadResponse(bufio.NewReader(buf), cacheKey.Request)
 	if err != nil {
 		return nil, err
 	}
+	if env != nil {
+		env.apply(resp)
+	}
+
+	// older entries may have been stored encoded
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	body = normalizeEncoding(cacheKey.Request, resp, body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	return &CacheEntry{Response: resp, Age: age}, nil
 }
 
-// set cached response
-func (hd *HTTPDisk) set(cacheKey *CacheKey, resp *http.Response, start time.Time, cacheErrors bool) error {
+// set cached response. remoteAddr is the server that sent it, if known.
+func (hd *HTTPDisk) set(cacheKey *CacheKey, resp *http.Response, start time.Time, remoteAddr string, opts fetchOptions) error {
+	// save the body on disk as it arrives, so the download can be resumed if
+	// it fails
+	var partial *partialBody
+	if hd.Options.ResumeDownloads && resumable(resp) {
+		partial = hd.recordPartial(cacheKey, resp)
+	}
+
 	// drain body, put back into Response
-	body, err := ioutil.ReadAll(resp.Body)
+	var body []byte
+	var err error
+	if hd.Options.MaxBodySize > 0 {
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, hd.Options.MaxBodySize+1))
+		if err == nil && int64(len(body)) > hd.Options.MaxBodySize {
+			// too big to cache, stream the rest to the caller
+			if hd.Options.Logger != nil {
+				hd.Options.Logger.Printf("Not caching %s (body is larger than MaxBodySize)", cacheKey.Request.URL)
+			}
+			if partial != nil {
+				partial.stop()
+			}
+			resp.Body = &streamingBody{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return nil
+		}
+	} else {
+		body, err = ioutil.ReadAll(resp.Body)
+	}
+	if err == nil && hd.Options.ResumeDownloads && isIncomplete(cacheKey.Request, resp, body) {
+		err = io.ErrUnexpectedEOF
+	}
+	if partial != nil {
+		partial.Close()
+	}
 	if err != nil {
+		// keep what we have so the download can be resumed, instead of caching
+		// the error
+		if partial != nil && !partial.stopped && len(body) > 0 {
+			if hd.Options.Logger != nil {
+				hd.Options.Logger.Printf("Saved %d bytes of %s for resuming", len(body), cacheKey.Request.URL)
+			}
+			return err
+		}
+		if partial != nil {
+			partial.stop()
+		}
+
 		// errors can occur here if the server returns an invalid body. handle that
 		// case and consider caching the error
-		if cacheErrors {
+		if opts.cacheErrors {
 			err = hd.handleError(cacheKey, err)
 		}
 		return err
 	}
+
+	// store the decoded body, whatever the Transport gave us
+	body = normalizeEncoding(cacheKey.Request, resp, body)
 	resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
 
-	// short circuit for http errors if cacheErrors=false
-	if !cacheErrors && isHttpError(resp) {
+	// short circuit for http errors if cacheHTTPErrors=false
+	if !opts.cacheHTTPErrors && isHttpError(resp) {
 		return nil
 	}
 
@@ -298,8 +891,15 @@ func (hd *HTTPDisk) set(cacheKey *CacheKey, resp *http.Response, start time.Time
 	resp.Header.Set("X-Gohttpdisk-Elapsed", fmt.Sprintf("%0.3f", elapsed))
 	resp.Header.Set("X-Gohttpdisk-Url", cacheKey.Request.URL.String())
 
-	// now cache bytes
+	// now cache bytes. Trailers go in the envelope instead of the dump.
+	trailer := resp.Trailer
+	resp.Trailer = nil
 	data, err := httputil.DumpResponse(resp, true)
+	resp.Trailer = trailer
+	if err != nil {
+		return err
+	}
+	data, err = hd.encodeEnvelope(resp, data, remoteAddr)
 	if err != nil {
 		return err
 	}
@@ -307,15 +907,18 @@ func (hd *HTTPDisk) set(cacheKey *CacheKey, resp *http.Response, start time.Time
 	if err != nil {
 		return err
 	}
+	if hd.Options.ResumeDownloads {
+		hd.Cache.RemoveMeta(cacheKey, partialMeta)
+	}
 
 	// restore body
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 	return nil
 }
 
 func (hd *HTTPDisk) handleError(cacheKey *CacheKey, err error) error {
-	if isCacheableError(err) {
-		err2 := hd.setError(cacheKey, err)
+	if category := hd.classifyError(err); category != "" {
+		err2 := hd.setError(cacheKey, err, category)
 		if err2 != nil {
 			// error while caching, give the caller a chance to see it
 			err = err2
@@ -325,52 +928,109 @@ func (hd *HTTPDisk) handleError(cacheKey *CacheKey, err error) error {
 }
 
 // cache an error response
-func (hd *HTTPDisk) setError(cacheKey *CacheKey, err error) error {
-	body := fmt.Sprintf("%s%s", errPrefix, err.Error())
-	err2 := hd.Cache.Set(cacheKey, []byte(body))
+func (hd *HTTPDisk) setError(cacheKey *CacheKey, err error, category ErrorCategory) error {
+	err2 := hd.Cache.Set(cacheKey, encodeError(err, category))
 	if err2 != nil {
 		return err2
 	}
 	return nil
 }
 
-func (hd *HTTPDisk) isStale(entry *CacheEntry) bool {
-	return entry != nil && hd.Options.MaxAge > 0 && entry.Age > hd.Options.MaxAge
+func (hd *HTTPDisk) isStale(entry *CacheEntry, settings *settings) bool {
+	if entry == nil {
+		return false
+	}
+	if hd.Options.Mode == ModeRFC {
+		return rfcAge(entry) >= rfcFreshness(entry)
+	}
+	if expired, ok := retryAfterExpired(entry); ok {
+		// rate limiting responses are only cached until Retry-After
+		return expired
+	}
+	maxAge := hd.maxAge(entry.Response, settings)
+	return maxAge > 0 && entry.Age > maxAge
 }
 
-// if err.Error() contains one of these, we consider the error to be cacheable
-// and we write it to disk. This list was generated by hitting the tranco top
-// 1000 websites.
-var cacheableErrors = []string{
-	"certificate has expired",
-	"certificate is valid",
-	"certificate signed by unknown authority",
-	"connection refused",
-	"connection reset by peer",
-	"context deadline exceeded",
-	"EOF",
-	"handshake failure",
-	"i/o timeout",
-	"no route to host",
-	"no such host",
-	"request canceled",
-	"stream error",
-	"tls: internal error",
-	"tls: unrecognized name",
+// Maximum age for a cached response, which depends on the status code.
+func (hd *HTTPDisk) maxAge(resp *http.Response, settings *settings) time.Duration {
+	if maxAge, ok := hd.Options.StatusMaxAge[resp.StatusCode]; ok && maxAge > 0 {
+		return maxAge
+	}
+	if resp.StatusCode >= 500 && hd.Options.ServerErrorMaxAge > 0 {
+		return hd.Options.ServerErrorMaxAge
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && hd.Options.ClientErrorMaxAge > 0 {
+		return hd.Options.ClientErrorMaxAge
+	}
+	return settings.maxAge
+}
+
+// Has this cached network error outlived ErrorMaxAge (or MaxAge)?
+func (hd *HTTPDisk) isExpiredError(cachedError *CachedError, settings *settings) bool {
+	maxAge := hd.Options.ErrorMaxAge
+	if maxAge <= 0 {
+		maxAge = settings.maxAge
+	}
+	return maxAge > 0 && cachedError.age > maxAge
 }
 
-func isCacheableError(err error) bool {
-	errorString := err.Error()
-	for _, s := range cacheableErrors {
-		if strings.Contains(errorString, s) {
-			return true
+// Can this stale entry be served if the refresh fails?
+func (hd *HTTPDisk) allowsStaleIfError(entry *CacheEntry, settings *settings) bool {
+	if settings.staleIfError <= 0 || !hd.allowsStale(entry) || isHttpError(entry.Response) {
+		return false
+	}
+	lifetime := hd.maxAge(entry.Response, settings)
+	age := entry.Age
+	if hd.Options.Mode == ModeRFC {
+		lifetime = rfcFreshness(entry)
+		age = rfcAge(entry)
+	}
+	return age-lifetime <= settings.staleIfError
+}
+
+// Can this stale entry be served while revalidating?
+func (hd *HTTPDisk) allowsStale(entry *CacheEntry) bool {
+	return hd.Options.Mode != ModeRFC || rfcAllowsStale(entry.Response)
+}
+
+// Calculate a partition from the values of the named cookies. Returns "" if
+// none of the cookies are present.
+func cookiePartition(req *http.Request, names []string) string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	values := []string{}
+	for _, name := range sorted {
+		if cookie, err := req.Cookie(name); err == nil {
+			values = append(values, fmt.Sprintf("%s=%s", name, cookie.Value))
 		}
 	}
+	if len(values) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("cookies-%s", md5String(strings.Join(values, "; ")))
+}
 
-	fmt.Printf("isCacheableError? type:%T v:%v\n", err, err)
-	return false
+// Add X-Gohttpdisk-Status to a response that is being returned, and Age if it
+// came from the cache. These are never stored. Misses keep the Age from the
+// server, if any. In RFC mode Age includes the Age from upstream caches, just
+// like the freshness check.
+func (hd *HTTPDisk) setStatusHeaders(resp *http.Response, status string, entry *CacheEntry) {
+	resp.Header.Set("X-Gohttpdisk-Status", status)
+	if entry == nil {
+		return
+	}
+	age := entry.Age
+	if hd.Options.Mode == ModeRFC {
+		age = rfcAge(entry)
+	}
+	resp.Header.Set("Age", fmt.Sprint(int64(age/time.Second)))
 }
 
 func isHttpError(resp *http.Response) bool {
 	return resp.StatusCode >= 400
 }
+
+func isServerError(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode >= 500
+}
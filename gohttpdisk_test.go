@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -555,6 +556,175 @@ func TestHTTPDiskStatus(t *testing.T) {
 	assert.Equal(t, "error", status.Status)
 }
 
+func TestHTTPDiskStatusHeaders(t *testing.T) {
+	var wg sync.WaitGroup
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxAge: 100 * time.Millisecond, StaleWhileRevalidate: true, RevalidationWaitGroup: &wg})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &counterRoundTripper{}
+
+	get := func() *http.Response {
+		resp, err := hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		return resp
+	}
+
+	// 1. miss
+	resp := get()
+	assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, "", resp.Header.Get("Age"))
+
+	// 2. hit
+	resp = get()
+	assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+
+	// 3. stale
+	time.Sleep(1100 * time.Millisecond)
+	resp = get()
+	assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, "1", resp.Header.Get("Age"))
+	wg.Wait()
+
+	// status headers are never stored
+	status, _ := hd.Status(MustRequest("GET", "http://httpbingo.org/get"))
+	data, _, _ := hd.Cache.Get(MustCacheKey(MustRequest("GET", "http://httpbingo.org/get")))
+	assert.Equal(t, "hit", status.Status)
+	assert.NotContains(t, string(data), "X-Gohttpdisk-Status")
+}
+
+func TestHTTPDiskStaleIfError(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxAge: 50 * time.Millisecond, StaleIfError: time.Hour})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{}
+	hd.Transport = transport
+
+	get := func() (*http.Response, error) {
+		return hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+	}
+
+	// 1. miss
+	resp, err := get()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", resp.Header.Get("X-Request-Id"))
+
+	// 2. stale, network error
+	time.Sleep(100 * time.Millisecond)
+	hd.Transport = &errorRoundTripper{"connection refused"}
+	resp, err = get()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", resp.Header.Get("X-Request-Id"))
+	assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Contains(t, resp.Header.Get("Warning"), "111")
+
+	// 3. stale, 5xx
+	hd.Transport = &counterRoundTripper{StatusCode: 503}
+	resp, err = get()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Request-Id"))
+
+	// 4. stale, success
+	hd.Transport = transport
+	resp, err = get()
+	assert.Nil(t, err)
+	assert.Equal(t, "2", resp.Header.Get("X-Request-Id"))
+	assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+
+	// 5. too stale
+	hd.Options.StaleIfError = 10 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	hd.Transport = &errorRoundTripper{"connection refused"}
+	_, err = get()
+	assert.NotNil(t, err)
+}
+
+func TestHTTPDiskErrorMaxAge(t *testing.T) {
+	hd := NewHTTPDisk(Options{
+		Dir:               TmpDir(),
+		ErrorMaxAge:       50 * time.Millisecond,
+		ClientErrorMaxAge: 50 * time.Millisecond,
+		StatusMaxAge:      map[int]time.Duration{401: -1},
+	})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	get := func(url string) (string, error) {
+		resp, err := hd.RoundTrip(MustRequest("GET", url))
+		if err != nil {
+			return "", err
+		}
+		return resp.Header.Get("X-Request-Id"), nil
+	}
+
+	// network errors expire
+	hd.Transport = &errorRoundTripper{"no such host"}
+	_, err := get("http://bogus.bogus")
+	assert.NotContains(t, err.Error(), "(cached)")
+	_, err = get("http://bogus.bogus")
+	assert.Contains(t, err.Error(), "(cached)")
+	time.Sleep(100 * time.Millisecond)
+	_, err = get("http://bogus.bogus")
+	assert.NotContains(t, err.Error(), "(cached)")
+
+	// 404s expire, 200s don't
+	hd.Transport = &counterRoundTripper{StatusCode: 404}
+	id, _ := get("http://httpbingo.org/status/404")
+	assert.Equal(t, "1", id)
+	id, _ = get("http://httpbingo.org/status/404")
+	assert.Equal(t, "1", id)
+	hd.Transport = &counterRoundTripper{}
+	id, _ = get("http://httpbingo.org/get")
+	assert.Equal(t, "1", id)
+	time.Sleep(100 * time.Millisecond)
+	id, _ = get("http://httpbingo.org/status/404")
+	assert.Equal(t, "2", id)
+	id, _ = get("http://httpbingo.org/get")
+	assert.Equal(t, "1", id)
+
+	// 401s are never cached
+	hd.Transport = &counterRoundTripper{StatusCode: 401}
+	id, _ = get("http://httpbingo.org/status/401")
+	assert.Equal(t, "1", id)
+	id, _ = get("http://httpbingo.org/status/401")
+	assert.Equal(t, "2", id)
+}
+
+func TestHTTPDiskPartitionCookies(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), PartitionCookies: []string{"session"}})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &counterRoundTripper{}
+
+	get := func(session string) string {
+		req := MustRequest("GET", "http://httpbingo.org/get")
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		resp, err := hd.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		return resp.Header.Get("X-Request-Id")
+	}
+
+	assert.Equal(t, "1", get(""))
+	assert.Equal(t, "2", get("alice"))
+	assert.Equal(t, "3", get("bob"))
+	assert.Equal(t, "1", get(""))
+	assert.Equal(t, "2", get("alice"))
+
+	// purge one partition
+	req := MustRequest("GET", "http://httpbingo.org/get")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "alice"})
+	status, _ := hd.Status(req)
+	assert.NoError(t, hd.Cache.RemovePartition(status.Partition))
+	assert.Equal(t, "4", get("alice"))
+	assert.Equal(t, "3", get("bob"))
+}
+
 //
 // Helpers
 //
@@ -607,6 +777,72 @@ func newVCR(t *testing.T) *recorder.Recorder {
 	return vcr
 }
 
+//
+// Custom RoundTripper that returns numbered responses, like the fixtures
+//
+
+type counterRoundTripper struct {
+	// Optional status code and headers for each response
+	StatusCode int
+	Header     http.Header
+
+	mu    sync.Mutex
+	count int
+}
+
+func (t *counterRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.count++
+	n := t.count
+	t.mu.Unlock()
+
+	statusCode := t.StatusCode
+	if statusCode == 0 {
+		statusCode = 200
+	}
+	resp := newResponse(r, statusCode, fmt.Sprintf("body %d", n))
+	for key, values := range t.Header {
+		resp.Header[key] = append([]string{}, values...)
+	}
+	resp.Header.Set("X-Request-Id", fmt.Sprint(n))
+	return resp, nil
+}
+
+func (t *counterRoundTripper) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+//
+// RoundTripper backed by a function
+//
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// build a simple response for a RoundTripper
+func newResponse(r *http.Request, statusCode int, body string, headers ...string) *http.Response {
+	header := http.Header{}
+	for i := 0; i < len(headers); i += 2 {
+		header.Add(headers[i], headers[i+1])
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
 //
 // Custom RoundTripper that always returns an error
 //
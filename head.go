@@ -0,0 +1,30 @@
+package gohttpdisk
+
+import (
+	"net/http"
+)
+
+// Look up the cached GET for a HEAD request. The entry is returned fresh or
+// stale, with its body dropped, so that it goes through the same stale
+// handling as the GET would. The GET's cache key comes along so that a stale
+// entry can be revalidated. Returns nil if no GET is cached.
+func (hd *HTTPDisk) headFromGet(req *http.Request, settings *settings) (*CacheEntry, *CacheKey) {
+	getReq := req.Clone(req.Context())
+	getReq.Method = "GET"
+	getReq.Body, getReq.GetBody, getReq.ContentLength = nil, nil, 0
+
+	cacheKey, err := hd.newCacheKey(getReq)
+	if err != nil {
+		return nil, nil
+	}
+	entry, err := hd.get(cacheKey, settings)
+	if entry == nil || err != nil {
+		return nil, nil
+	}
+
+	// headers only
+	entry.Response.Body.Close()
+	entry.Response.Body = http.NoBody
+	entry.Response.Request = req
+	return entry, cacheKey
+}
@@ -0,0 +1,76 @@
+package gohttpdisk
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadFromGet(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{HeadFromGet: true, MaxAge: 50 * time.Millisecond})
+	transport := &counterRoundTripper{}
+	hd.Transport = transport
+
+	url := "http://httpbingo.org/get"
+
+	// no GET yet, HEAD is fetched and stored
+	resp, err := hd.RoundTrip(MustRequest("HEAD", url))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", resp.Header.Get("X-Request-Id"))
+
+	// GET is cached, HEAD is answered from it
+	hd.RoundTrip(MustRequest("GET", url))
+	resp, err = hd.RoundTrip(MustRequest("HEAD", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", resp.Header.Get("X-Request-Id"))
+		assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+		assert.Equal(t, "HEAD", resp.Request.Method)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Empty(t, body)
+	}
+	assert.Equal(t, 2, transport.Count())
+
+	// GET is stale, HEAD is fetched but not stored
+	time.Sleep(100 * time.Millisecond)
+	resp, _ = hd.RoundTrip(MustRequest("HEAD", url))
+	assert.Equal(t, "3", resp.Header.Get("X-Request-Id"))
+	data, _, _ := hd.Cache.Get(MustCacheKey(MustRequest("HEAD", url)))
+	assert.Contains(t, string(data), "X-Request-Id: 1")
+}
+
+func TestHeadFromGetStale(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{HeadFromGet: true, MaxAge: 50 * time.Millisecond, StaleWhileRevalidate: true, StaleIfError: time.Hour})
+	transport := &counterRoundTripper{}
+	hd.Transport = transport
+
+	url := "http://httpbingo.org/get"
+	hd.RoundTrip(MustRequest("HEAD", url))
+	hd.RoundTrip(MustRequest("GET", url))
+	time.Sleep(100 * time.Millisecond)
+
+	// stale GET is served and revalidated in the background, and the HEAD
+	// stored earlier is never used
+	resp, err := hd.RoundTrip(MustRequest("HEAD", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", resp.Header.Get("X-Request-Id"))
+		assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+	assert.NoError(t, hd.Flush(context.Background()))
+	assert.Equal(t, 3, transport.Count())
+	resp, _ = hd.RoundTrip(MustRequest("HEAD", url))
+	assert.Equal(t, "3", resp.Header.Get("X-Request-Id"))
+
+	// stale if error
+	time.Sleep(100 * time.Millisecond)
+	hd.Options.StaleWhileRevalidate = false
+	hd.Transport = &errorRoundTripper{"connection refused"}
+	resp, err = hd.RoundTrip(MustRequest("HEAD", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "3", resp.Header.Get("X-Request-Id"))
+		assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+		assert.NotEmpty(t, resp.Header.Get("Warning"))
+	}
+}
@@ -0,0 +1,148 @@
+package gohttpdisk
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	defaultRevalidationWorkers   = 4
+	defaultRevalidationQueueSize = 100
+)
+
+// revalidator is a bounded pool of workers for background revalidation.
+// Pending revalidations are deduplicated by key. If the queue is full, new
+// revalidations are dropped, leaving the stale entry in place until the next
+// request for it. Workers are started lazily.
+type revalidator struct {
+	once    sync.Once
+	mu      sync.Mutex
+	queue   chan revalidation
+	pending map[string]bool
+	closed  bool
+	workers sync.WaitGroup
+
+	// number of queued or running revalidations, and a channel that is closed
+	// when that number drops to zero
+	outstanding int
+	idle        chan struct{}
+}
+
+var (
+	errRevalidationPending   = errors.New("revalidation already pending")
+	errRevalidationQueueFull = errors.New("revalidation queue full")
+	errRevalidatorClosed     = errors.New("revalidation closed")
+)
+
+type revalidation struct {
+	key string
+	fn  func()
+}
+
+func (r *revalidator) start(workers int, queueSize int) {
+	r.once.Do(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.closed {
+			return
+		}
+
+		if workers <= 0 {
+			workers = defaultRevalidationWorkers
+		}
+		if queueSize <= 0 {
+			queueSize = defaultRevalidationQueueSize
+		}
+		r.queue = make(chan revalidation, queueSize)
+		r.pending = map[string]bool{}
+		for i := 0; i < workers; i++ {
+			r.workers.Add(1)
+			go r.work()
+		}
+	})
+}
+
+func (r *revalidator) work() {
+	defer r.workers.Done()
+	for job := range r.queue {
+		job.fn()
+
+		r.mu.Lock()
+		delete(r.pending, job.key)
+		r.outstanding--
+		if r.outstanding == 0 {
+			close(r.idle)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Queue fn to run in the background. Fails if a revalidation for key is
+// already pending, the queue is full, or the pool has been closed.
+func (r *revalidator) enqueue(key string, fn func()) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.queue == nil {
+		return errRevalidatorClosed
+	}
+	if r.pending[key] {
+		return errRevalidationPending
+	}
+	select {
+	case r.queue <- revalidation{key: key, fn: fn}:
+	default:
+		return errRevalidationQueueFull
+	}
+
+	r.pending[key] = true
+	if r.outstanding == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.outstanding++
+	return nil
+}
+
+// Wait for all queued and running revalidations to finish.
+func (r *revalidator) flush(ctx context.Context) error {
+	r.mu.Lock()
+	if r.outstanding == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop accepting revalidations, then wait for the workers to drain the queue.
+func (r *revalidator) close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		if r.queue != nil {
+			close(r.queue)
+		}
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,106 @@
+package gohttpdisk
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidator(t *testing.T) {
+	var r revalidator
+	r.start(1, 2)
+
+	var count int32
+	block := make(chan struct{})
+	job := func() {
+		<-block
+		atomic.AddInt32(&count, 1)
+	}
+
+	// 1 running, 2 queued, then full
+	assert.NoError(t, r.enqueue("a", job))
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, r.enqueue("b", job))
+	assert.Equal(t, errRevalidationPending, r.enqueue("b", job))
+	assert.NoError(t, r.enqueue("c", job))
+	assert.Equal(t, errRevalidationQueueFull, r.enqueue("d", job))
+
+	// flush times out while blocked
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, r.flush(ctx))
+
+	close(block)
+	assert.NoError(t, r.flush(context.Background()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	// pending keys are cleared once done
+	assert.NoError(t, r.enqueue("a", job))
+	assert.NoError(t, r.close(context.Background()))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&count))
+	assert.Equal(t, errRevalidatorClosed, r.enqueue("a", job))
+}
+
+func TestHTTPDiskFlush(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxAge: 50 * time.Millisecond, StaleWhileRevalidate: true})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{}
+	hd.Transport = &slowRoundTripper{transport, 50 * time.Millisecond}
+
+	get := func() string {
+		resp, err := hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		return resp.Header.Get("X-Request-Id")
+	}
+
+	assert.Equal(t, "1", get())
+	time.Sleep(100 * time.Millisecond)
+
+	// many stale hits, only one revalidation
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "1", get())
+	}
+	assert.NoError(t, hd.Flush(context.Background()))
+	assert.Equal(t, 2, transport.Count())
+	assert.Equal(t, "2", get())
+
+	assert.NoError(t, hd.Close(context.Background()))
+}
+
+func TestBackgroundRevalidateSharesFetch(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxAge: 50 * time.Millisecond, StaleWhileRevalidate: true})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{Header: http.Header{"Etag": {`"v1"`}}}
+	hd.Transport = &slowRoundTripper{transport, 100 * time.Millisecond}
+
+	req := MustRequest("GET", "http://httpbingo.org/get")
+	hd.RoundTrip(req)
+	time.Sleep(100 * time.Millisecond)
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// a foreground fetch for the same key joins the background revalidation
+	opts := fetchOptions{store: true, cacheErrors: true, cacheHTTPErrors: true, validators: &validators{etag: `"v1"`}}
+	fetched := false
+	resp, _, err = hd.inflight.do(context.Background(), flightKey(req, MustCacheKey(req), opts), func() (*http.Response, bool, error) {
+		fetched = true
+		return hd.fetch(req, MustCacheKey(req), opts)
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", resp.Header.Get("X-Request-Id"))
+	}
+	assert.False(t, fetched)
+	assert.NoError(t, hd.Flush(context.Background()))
+	assert.Equal(t, 2, transport.Count())
+}
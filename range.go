@@ -0,0 +1,131 @@
+package gohttpdisk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Range requests share the cache key of the full request, since headers aren't
+// part of the key. A cached full 200 is sliced locally to answer them. Partial
+// 206 responses from the origin are passed through and never stored, so they
+// can't be mistaken for the full body later.
+
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// Is this a request for part of a resource?
+func isRangeRequest(req *http.Request) bool {
+	return req.Header.Get("Range") != "" && methodOrGet(req) == "GET"
+}
+
+// Answer a Range request from a cached full response. Returns resp unchanged
+// if the Range can't be applied, like when resp isn't a 200, If-Range doesn't
+// match, or the Range asks for multiple ranges. In all of those cases sending
+// the full response is allowed.
+func serveRange(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if !isRangeRequest(req) || resp.StatusCode != http.StatusOK || !ifRangeMatches(req, resp) {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	size := int64(len(body))
+
+	start, end, err := parseRange(req.Header.Get("Range"), size)
+	if err == errUnsatisfiableRange {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		body = nil
+	} else if err != nil {
+		// malformed or multiple ranges, send everything
+		return resp, nil
+	} else {
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		body = body[start : end+1]
+	}
+
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// Does the If-Range precondition (if any) match the cached response? Per RFC
+// 7233, only strong ETags and exact Last-Modified dates match.
+func ifRangeMatches(req *http.Request, resp *http.Response) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		etag := resp.Header.Get("ETag")
+		return etag != "" && etag == ifRange
+	}
+	if strings.HasPrefix(ifRange, "W/") {
+		return false
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+	return lastModified != "" && lastModified == ifRange
+}
+
+// Parse a single byte range like "bytes=0-99", "bytes=100-" or "bytes=-100"
+// against a body of size bytes. Returns the inclusive start and end.
+func parseRange(s string, size int64) (start, end int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	spec := strings.TrimSpace(s[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges not supported %q", s)
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if first == "" {
+		// suffix range, the last N bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end, nil
+}
@@ -0,0 +1,113 @@
+package gohttpdisk
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeRange(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{Header: http.Header{"Etag": {`"abc"`}}}
+	hd.Transport = transport
+
+	url := "http://httpbingo.org/get"
+	hd.RoundTrip(MustRequest("GET", url))
+
+	rangeRequest := func(rng, ifRange string) (*http.Response, string) {
+		req := MustRequest("GET", url)
+		req.Header.Set("Range", rng)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		resp, err := hd.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// the cached body is "body 1"
+	resp, body := rangeRequest("bytes=0-3", "")
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "body", body)
+	assert.Equal(t, "bytes 0-3/6", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "4", resp.Header.Get("Content-Length"))
+	assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+
+	resp, body = rangeRequest("bytes=-1", "")
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "1", body)
+
+	resp, body = rangeRequest("bytes=2-100", `"abc"`)
+	assert.Equal(t, 206, resp.StatusCode)
+	assert.Equal(t, "dy 1", body)
+
+	// If-Range doesn't match, full response
+	resp, body = rangeRequest("bytes=0-3", `"xyz"`)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "body 1", body)
+
+	// multiple ranges, full response
+	resp, body = rangeRequest("bytes=0-1,3-4", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "body 1", body)
+
+	resp, body = rangeRequest("bytes=10-", "")
+	assert.Equal(t, 416, resp.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Equal(t, "bytes */6", resp.Header.Get("Content-Range"))
+
+	assert.Equal(t, 1, transport.Count())
+}
+
+func TestPartialContentNotStored(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return newResponse(r, 206, "bo", "Content-Range", "bytes 0-1/6"), nil
+	})
+
+	req := MustRequest("GET", "http://httpbingo.org/get")
+	req.Header.Set("Range", "bytes=0-1")
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 206, resp.StatusCode)
+		assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+
+	data, _, _ := hd.Cache.Get(MustCacheKey(MustRequest("GET", "http://httpbingo.org/get")))
+	assert.Empty(t, data)
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s          string
+		start, end int64
+		err        bool
+	}{
+		{"bytes=0-0", 0, 0, false},
+		{"bytes=5-", 5, 9, false},
+		{"bytes=-3", 7, 9, false},
+		{"bytes=-30", 0, 9, false},
+		{"bytes=8-20", 8, 9, false},
+		{"bytes=10-", 0, 0, true},
+		{"bytes=5-2", 0, 0, true},
+		{"items=0-1", 0, 0, true},
+		{"bytes=abc", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseRange(tt.s, 10)
+		assert.Equal(t, tt.err, err != nil, tt.s)
+		if !tt.err {
+			assert.Equal(t, tt.start, start, tt.s)
+			assert.Equal(t, tt.end, end, tt.s)
+		}
+	}
+}
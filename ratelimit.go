@@ -0,0 +1,194 @@
+package gohttpdisk
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit keeps network traffic to each host polite. It only applies to
+// network requests, so cache hits are never slowed down.
+type RateLimit struct {
+	// Requests per second to each host. Zero means unlimited.
+	RequestsPerSecond float64
+
+	// Number of requests that can be made back to back before
+	// RequestsPerSecond kicks in. Defaults to 1.
+	Burst int
+
+	// Maximum number of concurrent requests to each host. Zero means
+	// unlimited. A request is active until its body has been read or closed.
+	MaxConcurrent int
+
+	// Minimum delay between the start of requests to the same host.
+	MinDelay time.Duration
+}
+
+// limiter tracks RateLimit state for each host. The zero value is ready to
+// use.
+type limiter struct {
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+	// defaults to the real clock, replaced in tests
+	clock clock
+}
+
+// The parts of package time that the limiter uses.
+type clock interface {
+	Now() time.Time
+	// like time.NewTimer, returns the channel and a function to stop it
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+func (l *limiter) getClock() clock {
+	if l.clock == nil {
+		return realClock{}
+	}
+	return l.clock
+}
+
+type hostLimit struct {
+	// theoretical arrival time for the token bucket (GCRA)
+	tat time.Time
+	// start of the most recent request
+	lastStart time.Time
+	// overrides RateLimit.MinDelay if larger, see robots.txt Crawl-delay
+	minDelay time.Duration
+	// concurrency slots, if MaxConcurrent is set
+	slots chan struct{}
+}
+
+func (l *limiter) host(host string, rateLimit *RateLimit) *hostLimit {
+	host = strings.ToLower(host)
+	if l.hosts == nil {
+		l.hosts = map[string]*hostLimit{}
+	}
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{}
+		if rateLimit.MaxConcurrent > 0 {
+			h.slots = make(chan struct{}, rateLimit.MaxConcurrent)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// Set a minimum delay for one host, like a robots.txt Crawl-delay.
+func (l *limiter) setMinDelay(host string, rateLimit *RateLimit, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.host(host, rateLimit).minDelay = delay
+}
+
+// Wait until a request to host is allowed. Returns a function that must be
+// called when the request is finished, and how long we waited. If ctx is done
+// while waiting, the reserved start time is given back so that later requests
+// aren't delayed by one that never happened.
+func (l *limiter) wait(ctx context.Context, host string, rateLimit *RateLimit) (release func(), waited time.Duration, err error) {
+	clock := l.getClock()
+	began := clock.Now()
+
+	l.mu.Lock()
+	h := l.host(host, rateLimit)
+	l.mu.Unlock()
+
+	// concurrency
+	release = func() {}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, clock.Now().Sub(began), ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-h.slots }) }
+	}
+
+	// reserve a start time
+	l.mu.Lock()
+	now := clock.Now()
+	start := now
+	var interval time.Duration
+	if rateLimit.RequestsPerSecond > 0 {
+		burst := rateLimit.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		interval = time.Duration(float64(time.Second) / rateLimit.RequestsPerSecond)
+		if earliest := h.tat.Add(-time.Duration(burst-1) * interval); earliest.After(start) {
+			start = earliest
+		}
+	}
+	minDelay := rateLimit.MinDelay
+	if h.minDelay > minDelay {
+		minDelay = h.minDelay
+	}
+	if !h.lastStart.IsZero() {
+		if earliest := h.lastStart.Add(minDelay); earliest.After(start) {
+			start = earliest
+		}
+	}
+	if interval > 0 {
+		if h.tat.Before(start) {
+			h.tat = start
+		}
+		h.tat = h.tat.Add(interval)
+	}
+	prevStart := h.lastStart
+	h.lastStart = start
+	l.mu.Unlock()
+
+	if delay := start.Sub(now); delay > 0 {
+		c, stop := clock.NewTimer(delay)
+		defer stop()
+		select {
+		case <-c:
+		case <-ctx.Done():
+			// give back the reservation
+			l.mu.Lock()
+			if interval > 0 {
+				h.tat = h.tat.Add(-interval)
+			}
+			if h.lastStart.Equal(start) {
+				h.lastStart = prevStart
+			}
+			l.mu.Unlock()
+			release()
+			return nil, clock.Now().Sub(began), ctx.Err()
+		}
+	}
+	return release, clock.Now().Sub(began), nil
+}
+
+// Body wrapper that calls release once the body is finished.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,141 @@
+package gohttpdisk
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterRequestsPerSecond(t *testing.T) {
+	clock := newFakeClock()
+	l := limiter{clock: clock}
+	rateLimit := &RateLimit{RequestsPerSecond: 20, Burst: 2}
+
+	start := clock.Now()
+	for i := 0; i < 6; i++ {
+		release, _, err := l.wait(context.Background(), "a.com", rateLimit)
+		assert.NoError(t, err)
+		release()
+	}
+	// burst of 2, then 4 more at 50ms intervals
+	assert.Equal(t, 200*time.Millisecond, clock.Now().Sub(start))
+
+	// other hosts aren't affected
+	_, waited, _ := l.wait(context.Background(), "b.com", rateLimit)
+	assert.Equal(t, time.Duration(0), waited)
+}
+
+func TestLimiterMinDelay(t *testing.T) {
+	clock := newFakeClock()
+	l := limiter{clock: clock}
+	rateLimit := &RateLimit{MinDelay: 50 * time.Millisecond}
+
+	l.wait(context.Background(), "a.com", rateLimit)
+	_, waited, _ := l.wait(context.Background(), "a.com", rateLimit)
+	assert.Equal(t, 50*time.Millisecond, waited)
+
+	// per-host override
+	l.setMinDelay("a.com", rateLimit, 100*time.Millisecond)
+	_, waited, _ = l.wait(context.Background(), "a.com", rateLimit)
+	assert.Equal(t, 100*time.Millisecond, waited)
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	rateLimits := []*RateLimit{
+		{MinDelay: 100 * time.Millisecond},
+		{RequestsPerSecond: 10},
+	}
+	for _, rateLimit := range rateLimits {
+		clock := newFakeClock()
+		l := limiter{clock: clock}
+		l.wait(context.Background(), "a.com", rateLimit)
+
+		// canceled while waiting
+		clock.setStopped(true)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err := l.wait(ctx, "a.com", rateLimit)
+		assert.Equal(t, context.Canceled, err)
+
+		// the abandoned slot doesn't delay the next request
+		clock.setStopped(false)
+		_, waited, _ := l.wait(context.Background(), "a.com", rateLimit)
+		assert.Equal(t, 100*time.Millisecond, waited)
+	}
+}
+
+func TestLimiterMaxConcurrent(t *testing.T) {
+	var l limiter
+	rateLimit := &RateLimit{MaxConcurrent: 1}
+
+	var released int32
+	release, _, _ := l.wait(context.Background(), "a.com", rateLimit)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&released, 1)
+		release()
+	}()
+	l.wait(context.Background(), "a.com", rateLimit)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&released))
+}
+
+func TestHTTPDiskRateLimit(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{RateLimit: &RateLimit{MinDelay: 50 * time.Millisecond, MaxConcurrent: 1}})
+	hd.Transport = &counterRoundTripper{}
+	hd.limiter.clock = newFakeClock()
+	get := func(url string) { discard(MustRoundTrip(t, hd, MustRequest("GET", url))) }
+
+	get("http://httpbingo.org/1")
+	get("http://httpbingo.org/2")
+	assert.Equal(t, int64(1), hd.Stats().ThrottleWaits)
+	assert.Equal(t, 50*time.Millisecond, hd.Stats().ThrottleWait)
+
+	// hits are never throttled
+	for i := 0; i < 5; i++ {
+		get("http://httpbingo.org/1")
+	}
+	assert.Equal(t, int64(1), hd.Stats().ThrottleWaits)
+	assert.Equal(t, int64(2), hd.Stats().Fetches)
+}
+
+//
+// Clock that only moves when the limiter waits. Timers fire at once, unless
+// the clock is stopped, in which case they never fire.
+//
+
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if !c.stopped {
+		c.now = c.now.Add(d)
+		ch <- c.now
+	}
+	return ch, func() bool { return true }
+}
+
+func (c *fakeClock) setStopped(stopped bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = stopped
+}
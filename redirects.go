@@ -0,0 +1,141 @@
+package gohttpdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// RedirectHop is a single redirect in a chain.
+type RedirectHop struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Location string `json:"location"`
+}
+
+// RedirectChain records how a start URL resolved to a final URL when an
+// http.Client followed redirects through gohttpdisk.
+type RedirectChain struct {
+	StartURL    string        `json:"start_url"`
+	FinalURL    string        `json:"final_url"`
+	FinalMethod string        `json:"final_method"`
+	Hops        []RedirectHop `json:"hops"`
+}
+
+// metadata name for redirect chains, see Cache.SetMeta
+const redirectsMeta = "redirects"
+
+// If req is the end of a redirect chain, record the chain under the start
+// request. http.Client links each redirected request to the response that
+// caused it with req.Response. Redirect responses carry the request their key
+// was computed from, so the start key doesn't depend on a body that has
+// already been sent. Chains that came entirely from the cache were recorded
+// when they were fetched, so they aren't written again.
+func (hd *HTTPDisk) recordRedirects(req *http.Request, resp *http.Response) error {
+	if req.Response == nil || isRedirect(resp) {
+		return nil
+	}
+
+	chain := &RedirectChain{FinalURL: req.URL.String(), FinalMethod: methodOrGet(req)}
+	start := req
+	fetched := isFetched(resp)
+	for r := req; r.Response != nil && r.Response.Request != nil; r = r.Response.Request {
+		prev := r.Response
+		hop := RedirectHop{URL: prev.Request.URL.String(), Status: prev.StatusCode, Location: prev.Header.Get("Location")}
+		chain.Hops = append([]RedirectHop{hop}, chain.Hops...)
+		start = prev.Request
+		fetched = fetched || isFetched(prev)
+	}
+	if start == req || !fetched {
+		return nil
+	}
+	chain.StartURL = start.URL.String()
+
+	cacheKey, err := hd.newCacheKey(start)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+	return hd.Cache.SetMeta(cacheKey, redirectsMeta, data)
+}
+
+// Redirects returns the recorded redirect chain for a start request, or nil
+// if req didn't redirect (or hasn't been fetched).
+func (hd *HTTPDisk) Redirects(req *http.Request) (*RedirectChain, error) {
+	cacheKey, err := hd.newCacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+	data, _, _ := hd.Cache.GetMeta(cacheKey, redirectsMeta)
+	if len(data) == 0 {
+		return nil, nil
+	}
+	chain := &RedirectChain{}
+	if err := json.Unmarshal(data, chain); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// Resolve returns the final cached response for a start request, following
+// the recorded redirect chain without touching the network. If req didn't
+// redirect, the chain is nil and the response is the cached response for req.
+// Returns ErrCacheMiss if the final response isn't cached.
+func (hd *HTTPDisk) Resolve(req *http.Request) (*http.Response, *RedirectChain, error) {
+	chain, err := hd.Redirects(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	final := req
+	if chain != nil {
+		if chain.FinalMethod == methodOrGet(req) && req.GetBody != nil {
+			// 307/308 preserve the method and the body
+			final = req.Clone(req.Context())
+			final.Body, _ = req.GetBody()
+		} else {
+			final, err = http.NewRequestWithContext(req.Context(), chain.FinalMethod, chain.FinalURL, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		final.URL, err = final.URL.Parse(chain.FinalURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		final.Host = ""
+	}
+
+	cacheKey, err := hd.newCacheKey(final)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := hd.readFromCache(cacheKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry == nil {
+		return nil, nil, fmt.Errorf("%w (%s)", ErrCacheMiss, final.URL.String())
+	}
+	return entry.Response, chain, nil
+}
+
+func isRedirect(resp *http.Response) bool {
+	return resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != ""
+}
+
+// Did resp come from the network, rather than from the cache?
+func isFetched(resp *http.Response) bool {
+	status := resp.Header.Get("X-Gohttpdisk-Status")
+	return status == StatusMiss || status == StatusRevalidated
+}
+
+func methodOrGet(req *http.Request) string {
+	if req.Method == "" {
+		return "GET"
+	}
+	return req.Method
+}
@@ -0,0 +1,114 @@
+package gohttpdisk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusFound)
+		default:
+			fmt.Fprintf(w, "final %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	client := http.Client{Transport: hd}
+	resp, err := client.Get(server.URL + "/a")
+	if err != nil {
+		t.Fatalf("Get failed %s", err)
+	}
+	resp.Body.Close()
+
+	// offline from here on
+	hd.Transport = &errorRoundTripper{"connection refused"}
+
+	resp, chain, err := hd.Resolve(MustRequest("GET", server.URL+"/a"))
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "final /c", string(body))
+		assert.Equal(t, server.URL+"/a", chain.StartURL)
+		assert.Equal(t, server.URL+"/c", chain.FinalURL)
+		assert.Equal(t, []RedirectHop{
+			{URL: server.URL + "/a", Status: 301, Location: "/b"},
+			{URL: server.URL + "/b", Status: 302, Location: "/c"},
+		}, chain.Hops)
+	}
+
+	// intermediate hops aren't start URLs
+	chain, _ = hd.Redirects(MustRequest("GET", server.URL+"/c"))
+	assert.Nil(t, chain)
+
+	// status
+	status, _ := hd.Status(MustRequest("GET", server.URL+"/a"))
+	assert.Equal(t, server.URL+"/c", status.Redirects.FinalURL)
+
+	// no redirects, just the cached response
+	resp, chain, err = hd.Resolve(MustRequest("GET", server.URL+"/c"))
+	assert.NoError(t, err)
+	assert.Nil(t, chain)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// not cached
+	_, _, err = hd.Resolve(MustRequest("GET", server.URL+"/nope"))
+	assert.ErrorIs(t, err, ErrCacheMiss)
+}
+
+func TestRedirectsPostBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a" {
+			http.Redirect(w, r, "/c", http.StatusSeeOther)
+			return
+		}
+		fmt.Fprint(w, "final")
+	}))
+	defer server.Close()
+
+	hd := NewHTTPDisk(Options{Dir: TmpDir()})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	client := http.Client{Transport: hd}
+
+	// a body without GetBody is consumed by the time the chain ends
+	post := func() *http.Request {
+		req := MustRequest("POST", server.URL+"/a")
+		req.Body = ioutil.NopCloser(strings.NewReader("q=1"))
+		return req
+	}
+	resp, err := client.Do(post())
+	if err != nil {
+		t.Fatalf("Do failed %s", err)
+	}
+	resp.Body.Close()
+
+	chain, err := hd.Redirects(post())
+	if assert.NoError(t, err) && assert.NotNil(t, chain) {
+		assert.Equal(t, server.URL+"/c", chain.FinalURL)
+		assert.Equal(t, "GET", chain.FinalMethod)
+	}
+
+	// chains served from the cache aren't written again
+	assert.NoError(t, hd.Cache.RemoveMeta(MustCacheKey(post()), redirectsMeta))
+	resp, err = client.Do(post())
+	if err != nil {
+		t.Fatalf("Do failed %s", err)
+	}
+	resp.Body.Close()
+	chain, _ = hd.Redirects(post())
+	assert.Nil(t, chain)
+}
@@ -0,0 +1,256 @@
+package gohttpdisk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metadata name for partial downloads, see Cache.SetMeta. Unlike other
+// metadata the file isn't compressed, so that it can be appended to.
+const partialMeta = "partial"
+
+// A body that was only partly downloaded, so that the download can be resumed
+// with a Range request. The file holds this as JSON on the first line, followed
+// by the body as it arrived.
+type partialDownload struct {
+	StatusCode int
+	Header     http.Header
+
+	path string
+	// where the body starts in the file, and how much of it there is
+	offset, size int64
+}
+
+// Can the rest of this response be fetched later? The server needs to give us
+// a validator for If-Range, otherwise the pieces might not belong together.
+func resumable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") == "none" {
+		return false
+	}
+	return ifRangeValidator(resp.Header) != ""
+}
+
+// Prefer a strong ETag, since weak ETags can't be used with If-Range.
+// Last-Modified is only strong if the response was sent at least a second
+// later, otherwise the body might have changed within the same second (RFC
+// 9110 8.8.2.2 and 13.1.5).
+func ifRangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		return etag
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return ""
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil || date.Sub(lastModified) < time.Second {
+		return ""
+	}
+	return header.Get("Last-Modified")
+}
+
+// Start saving the body of resp to disk as it is read, unless it is already
+// being saved because it was resumed. Returns nil if the file can't be
+// created.
+func (hd *HTTPDisk) recordPartial(cacheKey *CacheKey, resp *http.Response) *partialBody {
+	if body, ok := resp.Body.(*partialBody); ok {
+		return body
+	}
+	f, err := hd.createPartial(cacheKey, resp)
+	if err != nil {
+		if hd.Options.Logger != nil {
+			hd.Options.Logger.Printf("Can't save %s for resuming (%s)", cacheKey.Request.URL, err)
+		}
+		return nil
+	}
+	body := &partialBody{body: resp.Body, file: f}
+	resp.Body = body
+	return body
+}
+
+// Create the partial file for resp, with the headers but no body yet.
+func (hd *HTTPDisk) createPartial(cacheKey *CacheKey, resp *http.Response) (*os.File, error) {
+	header, err := json.Marshal(&partialDownload{StatusCode: resp.StatusCode, Header: resp.Header})
+	if err != nil {
+		return nil, err
+	}
+	path := hd.Cache.metapath(cacheKey, partialMeta)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load a previously saved partial download, if any. The body stays on disk.
+func (hd *HTTPDisk) loadPartial(cacheKey *CacheKey) *partialDownload {
+	path := hd.Cache.metapath(cacheKey, partialMeta)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	partial := &partialDownload{path: path}
+	if err := json.Unmarshal(line, partial); err != nil {
+		return nil
+	}
+	partial.offset = int64(len(line))
+	partial.size = stat.Size() - partial.offset
+	if partial.size <= 0 || ifRangeValidator(partial.Header) == "" {
+		return nil
+	}
+	return partial
+}
+
+// Returns a copy of req that asks for the rest of the body, as long as it
+// hasn't changed.
+func (partial *partialDownload) apply(req *http.Request) *http.Request {
+	req = req.Clone(req.Context())
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial.size))
+	req.Header.Set("If-Range", ifRangeValidator(partial.Header))
+	return req
+}
+
+// Stitch the saved partial body together with the rest of it from a 206. The
+// result looks like the original 200, and the rest is appended to the partial
+// file as it is read. Returns nil if the 206 doesn't pick up where the partial
+// body left off.
+func (partial *partialDownload) resume(resp *http.Response) *http.Response {
+	start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || start != partial.size {
+		return nil
+	}
+	if expected := partial.contentLength(); expected >= 0 && expected != total {
+		return nil
+	}
+	f, err := os.OpenFile(partial.path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil
+	}
+
+	header := partial.Header.Clone()
+	if total >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(total, 10))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", partial.StatusCode, http.StatusText(partial.StatusCode)),
+		StatusCode:    partial.StatusCode,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        header,
+		Body:          &partialBody{saved: io.NewSectionReader(f, partial.offset, partial.size), body: resp.Body, file: f},
+		ContentLength: total,
+		Request:       resp.Request,
+	}
+}
+
+// Content-Length of the original response, or -1 if unknown.
+func (partial *partialDownload) contentLength() int64 {
+	n, err := strconv.ParseInt(partial.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// The saved bytes, if any, followed by the rest from the network. Bytes from
+// the network are appended to the partial file as they are read.
+type partialBody struct {
+	saved   io.Reader
+	body    io.ReadCloser
+	file    *os.File
+	stopped bool
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	if b.saved != nil {
+		n, err := b.saved.Read(p)
+		if err == io.EOF {
+			b.saved, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	n, err := b.body.Read(p)
+	if n > 0 && !b.stopped {
+		if _, werr := b.file.Write(p[:n]); werr != nil {
+			b.stop()
+		}
+	}
+	return n, err
+}
+
+func (b *partialBody) Close() error {
+	b.file.Close()
+	return b.body.Close()
+}
+
+// Stop saving the body, and throw away what was saved.
+func (b *partialBody) stop() {
+	b.stopped = true
+	os.Remove(b.file.Name())
+}
+
+// Parse a Content-Range like "bytes 100-199/200". total is -1 if the server
+// sent "*".
+func parseContentRange(s string) (start, total int64, ok bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, 0, false
+	}
+	slash := strings.Index(s, "/")
+	dash := strings.Index(s, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(s[len(prefix):dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if s[slash+1:] != "*" {
+		if total, err = strconv.ParseInt(s[slash+1:], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// Is the body shorter than the Content-Length the server promised?
+func isIncomplete(req *http.Request, resp *http.Response, body []byte) bool {
+	if methodOrGet(req) == "HEAD" || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return err == nil && int64(len(body)) != n
+}
@@ -0,0 +1,176 @@
+package gohttpdisk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeDownloads(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	truncate := true
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if truncate {
+			// promise the whole body, but die halfway through
+			w.Header().Set("Content-Length", "1000")
+			w.Write([]byte(content[:400]))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{ResumeDownloads: true})
+	url := server.URL + "/big"
+	cacheKey := MustCacheKey(MustRequest("GET", url))
+
+	// first attempt fails, but the partial body is saved instead of an error
+	_, err := hd.RoundTrip(MustRequest("GET", url))
+	assert.Error(t, err)
+	data, _, _ := hd.Cache.Get(cacheKey)
+	assert.Empty(t, data)
+	partial := hd.loadPartial(cacheKey)
+	if assert.NotNil(t, partial) {
+		assert.Equal(t, int64(400), partial.size)
+		assert.Equal(t, content[:400], partialBodyString(partial))
+	}
+
+	// second attempt picks up where the first left off
+	truncate = false
+	resp, err := hd.RoundTrip(MustRequest("GET", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, content, string(body))
+	}
+	assert.Equal(t, []string{"", "bytes=400-"}, ranges)
+	assert.Nil(t, hd.loadPartial(cacheKey))
+
+	// and now it's cached
+	resp, err = hd.RoundTrip(MustRequest("GET", url))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, content, string(body))
+	}
+	assert.Len(t, ranges, 2)
+}
+
+func TestResumeChangedBody(t *testing.T) {
+	hd := TmpHTTPDisk(t, Options{ResumeDownloads: true})
+
+	// a partial body from an older version
+	req := MustRequest("GET", "http://httpbingo.org/get")
+	cacheKey := MustCacheKey(req)
+	old := newResponse(req, 200, "", "ETag", `"v1"`, "Content-Length", "6")
+	f, _ := hd.createPartial(cacheKey, old)
+	f.Write([]byte("old"))
+	f.Close()
+
+	// If-Range doesn't match, so the server sends everything
+	var ifRange string
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		ifRange = r.Header.Get("If-Range")
+		return newResponse(r, 200, "new body", "ETag", `"v2"`), nil
+	})
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "new body", string(body))
+	}
+	assert.Equal(t, `"v1"`, ifRange)
+	assert.Nil(t, hd.loadPartial(cacheKey))
+	data, _, _ := hd.Cache.Get(cacheKey)
+	assert.True(t, bytes.Contains(data, []byte("new body")))
+}
+
+func TestResumeTwice(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// each response dies after 300 bytes
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)-start))
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		end := start + 300
+		if end > len(content) {
+			end = len(content)
+		}
+		w.Write([]byte(content[start:end]))
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{ResumeDownloads: true})
+	url := server.URL + "/big"
+	cacheKey := MustCacheKey(MustRequest("GET", url))
+
+	// the partial file grows with each attempt
+	for _, size := range []int64{300, 600, 900} {
+		_, err := hd.RoundTrip(MustRequest("GET", url))
+		assert.Error(t, err)
+		if partial := hd.loadPartial(cacheKey); assert.NotNil(t, partial) {
+			assert.Equal(t, size, partial.size)
+			assert.Equal(t, content[:size], partialBodyString(partial))
+		}
+	}
+
+	resp, err := hd.RoundTrip(MustRequest("GET", url))
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, content, string(body))
+	}
+	assert.Nil(t, hd.loadPartial(cacheKey))
+}
+
+func TestIfRangeValidator(t *testing.T) {
+	date := "Mon, 02 Jan 2006 15:04:05 GMT"
+	header := func(kv ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	assert.Equal(t, `"v1"`, ifRangeValidator(header("ETag", `"v1"`, "Last-Modified", date)))
+	assert.Equal(t, "", ifRangeValidator(header("ETag", `W/"v1"`)))
+
+	// Last-Modified only if it's strong
+	assert.Equal(t, date, ifRangeValidator(header("Last-Modified", date, "Date", "Mon, 02 Jan 2006 15:04:06 GMT")))
+	assert.Equal(t, "", ifRangeValidator(header("Last-Modified", date, "Date", date)))
+	assert.Equal(t, "", ifRangeValidator(header("Last-Modified", date)))
+}
+
+// the body saved in a partial file
+func partialBodyString(partial *partialDownload) string {
+	data, _ := ioutil.ReadFile(partial.path)
+	return string(data[partial.offset:])
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, total, ok := parseContentRange("bytes 100-199/200")
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), start)
+	assert.Equal(t, int64(200), total)
+
+	_, total, ok = parseContentRange("bytes 5-9/*")
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1), total)
+
+	_, _, ok = parseContentRange("bytes */200")
+	assert.False(t, ok)
+}
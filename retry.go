@@ -0,0 +1,313 @@
+package gohttpdisk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default for Options.RetryAfterMaxWait
+const defaultRetryAfterMaxWait = time.Minute
+
+// errCantRewind is returned when a request must be resent, but its body can't
+// be read a second time.
+var errCantRewind = errors.New("can't resend request body")
+
+// RetryPolicy retries transient failures with exponential backoff. Only the
+// final outcome is cached, so a reset on the first attempt isn't cached as a
+// permanent error.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first. Defaults to 3.
+	MaxAttempts int
+
+	// Wait before the first retry. Doubles after each attempt. Defaults to
+	// 500ms.
+	InitialBackoff time.Duration
+
+	// Longest wait between attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+
+	// Fraction of each wait that is randomized, between 0 and 1. Defaults to
+	// 0.2. Use a negative value to disable jitter.
+	Jitter float64
+
+	// Network error categories to retry. Defaults to timeout, refused, reset, eof
+	// and stream.
+	Categories []ErrorCategory
+
+	// Status codes to retry. Defaults to 502, 503 and 504.
+	StatusCodes []int
+}
+
+var (
+	defaultRetryCategories  = []ErrorCategory{CategoryTimeout, CategoryRefused, CategoryReset, CategoryEOF, CategoryStream}
+	defaultRetryStatusCodes = []int{502, 503, 504}
+)
+
+// Make the network request. Waits and retries if the server asks us to with
+// Retry-After, or if Options.Retry says the failure is transient.
+func (hd *HTTPDisk) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	maxWait := hd.Options.RetryAfterMaxWait
+	if maxWait <= 0 {
+		maxWait = defaultRetryAfterMaxWait
+	}
+	policy := hd.Options.Retry
+
+	retryAfterAttempts := 0
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			var err error
+			if req, err = rewindBody(req); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := hd.throttledRoundTrip(transport, req)
+		if !canRewind(req) {
+			return resp, err
+		}
+
+		// Retry-After
+		if err == nil && retryAfterAttempts < hd.Options.RetryAfterRetries {
+			if wait, ok := retryAfterWait(resp); ok && wait <= maxWait {
+				if hd.Options.Logger != nil {
+					hd.Options.Logger.Printf("%s on %s, waiting %s before retrying", resp.Status, req.URL, wait)
+				}
+				discard(resp)
+				retryAfterAttempts++
+				atomic.AddInt64(&hd.stats.retryAfterWaits, 1)
+				atomic.AddInt64(&hd.stats.retryAfterWait, int64(wait))
+				if err := sleep(req, wait); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		// RetryPolicy
+		if policy != nil && attempt < policy.maxAttempts() && policy.retryable(resp, err) {
+			wait := policy.backoff(attempt)
+			if err == nil {
+				// the server may know better
+				if retryAfter, ok := retryAfterWait(resp); ok && retryAfter > wait {
+					if retryAfter > policy.maxBackoff() {
+						return resp, nil
+					}
+					wait = retryAfter
+				}
+			}
+
+			if hd.Options.Logger != nil {
+				reason := fmt.Sprint(err)
+				if err == nil {
+					reason = resp.Status
+				}
+				hd.Options.Logger.Printf("Attempt %d on %s failed (%s), retrying in %s", attempt, req.URL, reason, wait)
+			}
+			if resp != nil {
+				discard(resp)
+			}
+			atomic.AddInt64(&hd.stats.retries, 1)
+			if err := sleep(req, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		return resp, err
+	}
+}
+
+func (policy *RetryPolicy) maxAttempts() int {
+	if policy.MaxAttempts <= 0 {
+		return 3
+	}
+	return policy.MaxAttempts
+}
+
+func (policy *RetryPolicy) maxBackoff() time.Duration {
+	if policy.MaxBackoff <= 0 {
+		return 30 * time.Second
+	}
+	return policy.MaxBackoff
+}
+
+// Should this outcome be retried?
+func (policy *RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		categories := policy.Categories
+		if categories == nil {
+			categories = defaultRetryCategories
+		}
+		category := ClassifyError(err)
+		for _, c := range categories {
+			if c == category {
+				return true
+			}
+		}
+		return false
+	}
+
+	statusCodes := policy.StatusCodes
+	if statusCodes == nil {
+		statusCodes = defaultRetryStatusCodes
+	}
+	for _, code := range statusCodes {
+		if code == resp.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// How long to wait after this attempt?
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := policy.InitialBackoff
+	if wait <= 0 {
+		wait = 500 * time.Millisecond
+	}
+	for i := 1; i < attempt && wait < policy.maxBackoff(); i++ {
+		wait *= 2
+	}
+	if wait > policy.maxBackoff() {
+		wait = policy.maxBackoff()
+	}
+
+	jitter := policy.Jitter
+	if jitter == 0 {
+		jitter = 0.2
+	}
+	if jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		// spread the wait over [wait * (1 - jitter), wait]
+		wait -= time.Duration(rand.Float64() * jitter * float64(wait))
+	}
+	return wait
+}
+
+// Drain and close a response we're about to throw away, so the connection can
+// be reused.
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Sleep, unless the request is cancelled first.
+func sleep(req *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// Make a single network request, honoring Options.RateLimit.
+func (hd *HTTPDisk) throttledRoundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	rateLimit := hd.Options.RateLimit
+	if rateLimit == nil {
+		atomic.AddInt64(&hd.stats.fetches, 1)
+		return transport.RoundTrip(req)
+	}
+
+	release, waited, err := hd.limiter.wait(req.Context(), req.URL.Hostname(), rateLimit)
+	if waited >= time.Millisecond {
+		atomic.AddInt64(&hd.stats.throttleWaits, 1)
+		atomic.AddInt64(&hd.stats.throttleWait, int64(waited))
+		if hd.Options.Logger != nil {
+			hd.Options.Logger.Printf("Throttled %s for %s", req.URL, waited.Round(time.Millisecond))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&hd.stats.fetches, 1)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// Can this request be sent again?
+func canRewind(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// Prepare a request to be sent again, which requires a fresh body.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errCantRewind
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+// Is this a rate limiting response (429 or 503)?
+func isRateLimited(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// How long does a rate limiting response ask us to wait?
+func retryAfterWait(resp *http.Response) (time.Duration, bool) {
+	if !isRateLimited(resp) {
+		return 0, false
+	}
+	retryAfter := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if retryAfter == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// Has the Retry-After time on a cached rate limiting response passed? ok is
+// false if the response doesn't have a usable Retry-After.
+func retryAfterExpired(entry *CacheEntry) (expired bool, ok bool) {
+	resp := entry.Response
+	if !isRateLimited(resp) {
+		return false, false
+	}
+	retryAfter := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if seconds, err := strconv.ParseInt(retryAfter, 10, 64); err == nil {
+		return entry.Age > time.Duration(seconds)*time.Second, true
+	}
+	if t, err := http.ParseTime(retryAfter); err == nil {
+		return time.Now().After(t), true
+	}
+	return false, false
+}
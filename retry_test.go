@@ -0,0 +1,152 @@
+package gohttpdisk
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAfterWait(t *testing.T) {
+	req := MustRequest("GET", "http://a.com")
+
+	wait, ok := retryAfterWait(newResponse(req, 429, "", "Retry-After", "3"))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	wait, ok = retryAfterWait(newResponse(req, 503, "", "Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)))
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Hour), float64(wait), float64(2*time.Second))
+
+	_, ok = retryAfterWait(newResponse(req, 429, ""))
+	assert.False(t, ok)
+	_, ok = retryAfterWait(newResponse(req, 500, "", "Retry-After", "3"))
+	assert.False(t, ok)
+}
+
+func TestRetryAfterExpired(t *testing.T) {
+	req := MustRequest("GET", "http://a.com")
+
+	entry := &CacheEntry{Response: newResponse(req, 429, "", "Retry-After", "60"), Age: time.Second}
+	expired, ok := retryAfterExpired(entry)
+	assert.True(t, ok)
+	assert.False(t, expired)
+
+	entry.Age = 2 * time.Minute
+	expired, _ = retryAfterExpired(entry)
+	assert.True(t, expired)
+
+	entry = &CacheEntry{Response: newResponse(req, 503, "", "Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))}
+	expired, _ = retryAfterExpired(entry)
+	assert.True(t, expired)
+
+	_, ok = retryAfterExpired(&CacheEntry{Response: newResponse(req, 200, "", "Retry-After", "60")})
+	assert.False(t, ok)
+}
+
+func TestHTTPDiskRetryAfter(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), RetryAfterRetries: 2})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	// 429, 429, 200
+	count := 0
+	var bodies []string
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		count++
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if count < 3 {
+			return newResponse(r, 429, "slow down", "Retry-After", "0"), nil
+		}
+		return newResponse(r, 200, "ok"), nil
+	})
+
+	req, _ := http.NewRequest("POST", "http://httpbingo.org/post", strings.NewReader("hello"))
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+	assert.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+	assert.Equal(t, int64(3), hd.Stats().Fetches)
+	assert.Equal(t, int64(2), hd.Stats().RetryAfterWaits)
+
+	// gives up after RetryAfterRetries, and caches until Retry-After
+	count = 0
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		count++
+		return newResponse(r, 429, "slow down", "Retry-After", "1"), nil
+	})
+	hd.Options.RetryAfterMaxWait = time.Millisecond
+	resp, _ = hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+	assert.Equal(t, 429, resp.StatusCode)
+	hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+	assert.Equal(t, 1, count)
+	time.Sleep(1100 * time.Millisecond)
+	hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+	assert.Equal(t, 2, count)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: -1}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 400*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, time.Second, policy.backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		wait := policy.backoff(2)
+		assert.True(t, wait >= 100*time.Millisecond && wait <= 200*time.Millisecond)
+	}
+}
+
+func TestHTTPDiskRetry(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), Retry: &RetryPolicy{InitialBackoff: time.Millisecond}})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	// reset, 502, 200
+	count := 0
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		count++
+		switch count {
+		case 1:
+			return nil, errors.New("read: connection reset by peer")
+		case 2:
+			return newResponse(r, 502, "bad gateway"), nil
+		}
+		return newResponse(r, 200, "ok"), nil
+	})
+	resp, err := hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+	assert.Equal(t, int64(2), hd.Stats().Retries)
+
+	// retries exhausted, then the error is cached
+	count = 0
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		count++
+		return nil, errors.New("read: connection reset by peer")
+	})
+	_, err = hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/delay/1"))
+	assert.NotContains(t, err.Error(), "(cached)")
+	assert.Equal(t, 3, count)
+	_, err = hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/delay/1"))
+	assert.Contains(t, err.Error(), "(cached)")
+	assert.Equal(t, 3, count)
+
+	// not retryable
+	count = 0
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		count++
+		return newResponse(r, 404, "not found"), nil
+	})
+	hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/status/404"))
+	assert.Equal(t, 1, count)
+}
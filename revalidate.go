@@ -0,0 +1,80 @@
+package gohttpdisk
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Validators from a stale cached response, used to make a conditional request
+// when revalidating.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// Returns nil if the response doesn't have any validators.
+func newValidators(resp *http.Response) *validators {
+	v := &validators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if v.etag == "" && v.lastModified == "" {
+		return nil
+	}
+	return v
+}
+
+// Returns a copy of req with conditional headers. If the caller already made
+// the request conditional, req is returned unchanged along with false.
+func (v *validators) apply(req *http.Request) (*http.Request, bool) {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return req, false
+	}
+
+	req = req.Clone(req.Context())
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+	return req, true
+}
+
+// Handle a 304 Not Modified by merging its headers into the cached response.
+// The body comes from the cache, so nothing is downloaded. Returns nil if the
+// cached response has disappeared.
+func (hd *HTTPDisk) notModified(cacheKey *CacheKey, notModified *http.Response, start time.Time, remoteAddr string, store bool) (*http.Response, error) {
+	io.Copy(ioutil.Discard, notModified.Body)
+	notModified.Body.Close()
+
+	entry, err := hd.readFromCache(cacheKey)
+	if entry == nil || err != nil {
+		return nil, nil
+	}
+
+	resp := entry.Response
+	for key, values := range notModified.Header {
+		switch key {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			// these describe the (empty) 304 body, not ours
+		default:
+			resp.Header[key] = values
+		}
+	}
+
+	if !store {
+		return resp, nil
+	}
+
+	// rewrite the entry, which also resets its age
+	if err := hd.set(cacheKey, resp, start, remoteAddr, fetchOptions{store: true, cacheErrors: true, cacheHTTPErrors: true}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
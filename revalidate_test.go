@@ -0,0 +1,83 @@
+package gohttpdisk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidate(t *testing.T) {
+	var requests, notModified int32
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Request-Id", fmt.Sprint(n))
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), MaxAge: 50 * time.Millisecond, RevalidationWaitGroup: &wg})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+
+	get := func() *http.Response {
+		resp, err := hd.RoundTrip(MustRequest("GET", server.URL))
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		return resp
+	}
+
+	// 1. miss
+	resp := get()
+	assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+
+	// 2. stale, revalidated in the foreground
+	time.Sleep(100 * time.Millisecond)
+	resp = get()
+	assert.Equal(t, StatusRevalidated, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, "2", resp.Header.Get("X-Request-Id"), "headers merged")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	// 3. fresh again
+	resp = get()
+	assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// 4. stale, revalidated in the background
+	hd.Options.StaleWhileRevalidate = true
+	time.Sleep(100 * time.Millisecond)
+	resp = get()
+	assert.Equal(t, StatusStale, resp.Header.Get("X-Gohttpdisk-Status"))
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&notModified))
+	resp = get()
+	assert.Equal(t, StatusHit, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, "3", resp.Header.Get("X-Request-Id"))
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+
+	// 5. changed on the server
+	etag = `"v2"`
+	time.Sleep(100 * time.Millisecond)
+	hd.Options.StaleWhileRevalidate = false
+	resp = get()
+	assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	assert.Equal(t, `"v2"`, resp.Header.Get("ETag"))
+}
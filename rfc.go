@@ -0,0 +1,181 @@
+package gohttpdisk
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode controls how RoundTrip decides what to cache.
+type Mode int
+
+const (
+	// ModeAggressive caches everything, forever (or until MaxAge). This is the
+	// default.
+	ModeAggressive Mode = iota
+
+	// ModeRFC behaves like a shared HTTP cache as described in RFC 9111. It
+	// honors Cache-Control, Expires and Pragma, only caches GET and HEAD, and
+	// never caches network errors. MaxAge is ignored in favor of the freshness
+	// lifetime from the response.
+	ModeRFC
+)
+
+// Status codes that are cacheable by default (RFC 9110 15.1), meaning they can
+// be given a heuristic freshness lifetime.
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 206: true, 300: true, 301: true,
+	308: true, 404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Apply request directives to settings. Network errors are never cached, but
+// http errors are stored if rfcStorable allows it.
+func (settings *settings) applyRFC(req *http.Request) {
+	settings.cacheErrors = false
+
+	if req.Method != "" && req.Method != "GET" && req.Method != "HEAD" {
+		settings.force = true
+		settings.noStore = true
+		return
+	}
+
+	cc := parseCacheControl(req.Header)
+	if cc.has("no-store") {
+		settings.force = true
+		settings.noStore = true
+	}
+	if cc.has("no-cache") || (len(req.Header.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache")) {
+		settings.force = true
+	}
+	if cc.has("only-if-cached") {
+		settings.cacheOnly = true
+	}
+}
+
+// Is this response allowed to be stored by a shared cache?
+func rfcStorable(req *http.Request, resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	// shared caches can't store authenticated responses without permission
+	if req.Header.Get("Authorization") != "" {
+		if !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+			return false
+		}
+	}
+
+	// the key ignores request headers, so we can't handle Vary
+	for _, vary := range resp.Header.Values("Vary") {
+		for _, field := range strings.Split(vary, ",") {
+			field = strings.TrimSpace(field)
+			if field != "" && !strings.EqualFold(field, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+
+	// must have explicit freshness or be heuristically cacheable
+	if cc.has("public") || cc.has("max-age") || cc.has("s-maxage") || resp.Header.Get("Expires") != "" {
+		return true
+	}
+	return heuristicallyCacheable[resp.StatusCode]
+}
+
+// How long is this cached response fresh?
+func rfcFreshness(entry *CacheEntry) time.Duration {
+	resp := entry.Response
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.duration("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.duration("max-age"); ok {
+		return d
+	}
+
+	// without a valid Date, use the time the response was stored
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = time.Now().Add(-entry.Age)
+	}
+
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || t.Before(date) {
+			// invalid dates mean "already expired"
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	// heuristic freshness, 10% of the time since last modification
+	if heuristicallyCacheable[resp.StatusCode] {
+		if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+			return date.Sub(lastModified) / 10
+		}
+	}
+
+	return 0
+}
+
+// Age of a cached response, including any Age reported by upstream caches.
+func rfcAge(entry *CacheEntry) time.Duration {
+	age := entry.Age
+	if seconds, err := strconv.ParseInt(entry.Response.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age
+}
+
+// Can this response be served after it becomes stale?
+func rfcAllowsStale(resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	return !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("no-cache") && !cc.has("s-maxage")
+}
+
+//
+// Cache-Control parsing
+//
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) duration(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		// invalid values mean "already stale"
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
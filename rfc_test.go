@@ -0,0 +1,148 @@
+package gohttpdisk
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRFCFreshness(t *testing.T) {
+	freshness := func(status int, headers ...string) time.Duration {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		for i := 0; i < len(headers); i += 2 {
+			resp.Header.Add(headers[i], headers[i+1])
+		}
+		return rfcFreshness(&CacheEntry{Response: resp})
+	}
+
+	now := time.Now().UTC()
+	date := now.Format(http.TimeFormat)
+
+	assert.Equal(t, 60*time.Second, freshness(200, "Cache-Control", "max-age=60"))
+	assert.Equal(t, 30*time.Second, freshness(200, "Cache-Control", "max-age=60, s-maxage=30"))
+	assert.Equal(t, time.Duration(0), freshness(200, "Cache-Control", "max-age=60, no-cache"))
+	assert.Equal(t, time.Hour, freshness(200, "Date", date, "Expires", now.Add(time.Hour).Format(http.TimeFormat)))
+	assert.Equal(t, time.Duration(0), freshness(200, "Date", date, "Expires", "0"))
+	assert.Equal(t, time.Hour, freshness(200, "Date", date, "Last-Modified", now.Add(-10*time.Hour).Format(http.TimeFormat)))
+	assert.Equal(t, time.Duration(0), freshness(302, "Date", date, "Last-Modified", now.Add(-10*time.Hour).Format(http.TimeFormat)))
+	assert.Equal(t, time.Duration(0), freshness(200))
+
+	// without a Date, Expires is relative to when the response was stored
+	assert.InDelta(t, float64(time.Hour), float64(freshness(200, "Expires", now.Add(time.Hour).Format(http.TimeFormat))), float64(2*time.Second))
+	assert.InDelta(t, float64(time.Hour), float64(freshness(200, "Date", "bogus", "Expires", now.Add(time.Hour).Format(http.TimeFormat))), float64(2*time.Second))
+}
+
+func TestRFCStorable(t *testing.T) {
+	storable := func(req *http.Request, status int, headers ...string) bool {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		for i := 0; i < len(headers); i += 2 {
+			resp.Header.Add(headers[i], headers[i+1])
+		}
+		return rfcStorable(req, resp)
+	}
+
+	req := MustRequest("GET", "http://a.com")
+	assert.True(t, storable(req, 200))
+	assert.True(t, storable(req, 302, "Cache-Control", "max-age=60"))
+	assert.False(t, storable(req, 302))
+	assert.False(t, storable(req, 200, "Cache-Control", "no-store"))
+	assert.False(t, storable(req, 200, "Cache-Control", "private, max-age=60"))
+	assert.False(t, storable(req, 200, "Vary", "Cookie"))
+	assert.True(t, storable(req, 200, "Vary", "Accept-Encoding"))
+
+	req.Header.Set("Authorization", "Bearer x")
+	assert.False(t, storable(req, 200, "Cache-Control", "max-age=60"))
+	assert.True(t, storable(req, 200, "Cache-Control", "public, max-age=60"))
+}
+
+func TestRFCRoundTrip(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), Mode: ModeRFC})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{Header: http.Header{"Cache-Control": {"max-age=60"}}}
+	hd.Transport = transport
+
+	get := func(method string, headers ...string) string {
+		req := MustRequest(method, "http://httpbingo.org/get")
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		resp, err := hd.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed %s", err)
+		}
+		return resp.Header.Get("X-Request-Id")
+	}
+
+	assert.Equal(t, "1", get("GET"))
+	assert.Equal(t, "1", get("GET"))
+
+	// request directives
+	assert.Equal(t, "2", get("GET", "Cache-Control", "no-cache"))
+	assert.Equal(t, "2", get("GET"))
+	assert.Equal(t, "3", get("GET", "Pragma", "no-cache"))
+	assert.Equal(t, "4", get("GET", "Cache-Control", "no-store"))
+	assert.Equal(t, "3", get("GET"))
+
+	// only GET and HEAD
+	assert.Equal(t, "5", get("POST"))
+	assert.Equal(t, "6", get("POST"))
+
+	// response directives
+	transport.Header.Set("Cache-Control", "no-store")
+	assert.Equal(t, "7", get("GET", "Cache-Control", "no-cache"))
+	assert.Equal(t, "3", get("GET"))
+}
+
+func TestRFCHttpErrors(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), Mode: ModeRFC})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	transport := &counterRoundTripper{StatusCode: 404, Header: http.Header{"Cache-Control": {"max-age=3600"}}}
+	hd.Transport = transport
+
+	// a cacheable 404 is stored like any other response
+	url := "http://httpbingo.org/missing"
+	for _, status := range []string{StatusMiss, StatusError} {
+		resp, err := hd.RoundTrip(MustRequest("GET", url))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 404, resp.StatusCode)
+			assert.Equal(t, status, resp.Header.Get("X-Gohttpdisk-Status"))
+		}
+	}
+	assert.Equal(t, 1, transport.Count())
+
+	// a 500 isn't heuristically cacheable
+	transport.StatusCode = 500
+	transport.Header = nil
+	hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/broken"))
+	hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/broken"))
+	assert.Equal(t, 3, transport.Count())
+
+	// network errors cached in aggressive mode aren't replayed
+	req := MustRequest("GET", "http://httpbingo.org/unreachable")
+	hd.setError(MustCacheKey(req), errors.New("no such host"), CategoryDNS)
+	resp, err := hd.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusMiss, resp.Header.Get("X-Gohttpdisk-Status"))
+	}
+}
+
+func TestRFCAge(t *testing.T) {
+	hd := NewHTTPDisk(Options{Dir: TmpDir(), Mode: ModeRFC})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &counterRoundTripper{Header: http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"30"}}}
+
+	// the miss keeps the Age from upstream, the hit adds its own to it
+	for _, status := range []string{StatusMiss, StatusHit} {
+		resp, err := hd.RoundTrip(MustRequest("GET", "http://httpbingo.org/get"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, status, resp.Header.Get("X-Gohttpdisk-Status"))
+			assert.Equal(t, "30", resp.Header.Get("Age"), status)
+		}
+	}
+}
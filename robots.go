@@ -0,0 +1,316 @@
+package gohttpdisk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDisallowedByRobots is returned when robots.txt doesn't allow a URL. See
+// Options.RobotsUserAgent.
+var ErrDisallowedByRobots = errors.New("disallowed by robots.txt")
+
+// Only this much of robots.txt is parsed (RFC 9309 2.5)
+const maxRobotsSize = 500 * 1024
+
+// robots.txt is refetched after this long, regardless of Options.MaxAge (RFC
+// 9309 2.4)
+const robotsMaxAge = 24 * time.Hour
+
+// A server error for robots.txt disallows the host, and a network error allows
+// it, but only until we try again after this long.
+const robotsErrorMaxAge = time.Minute
+
+// Parsed robots.txt for each host, so that it isn't read from disk and parsed
+// again for every request. The zero value is ready to use.
+type robotsCache struct {
+	mu    sync.Mutex
+	hosts map[string]*robotsCacheEntry
+}
+
+type robotsCacheEntry struct {
+	robots  *robots
+	expires time.Time
+}
+
+func (c *robotsCache) get(host string) *robots {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.hosts[host]; ok && time.Now().Before(entry.expires) {
+		return entry.robots
+	}
+	return nil
+}
+
+func (c *robotsCache) set(host string, robots *robots, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = map[string]*robotsCacheEntry{}
+	}
+	c.hosts[host] = &robotsCacheEntry{robots: robots, expires: time.Now().Add(maxAge)}
+}
+
+// Check robots.txt before fetching a URL. robots.txt itself is cached on disk
+// for up to robotsMaxAge, and in memory once parsed.
+func (hd *HTTPDisk) checkRobots(req *http.Request) error {
+	if req.URL.Path == "/robots.txt" {
+		return nil
+	}
+
+	host := fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host)
+	r := hd.robotsCache.get(host)
+	if r == nil {
+		var err error
+		r, err = hd.robots(req)
+		maxAge := robotsMaxAge
+		if err != nil {
+			// couldn't reach the host, let the real request fail instead. Our
+			// own cancellation isn't remembered.
+			if req.Context().Err() != nil {
+				return nil
+			}
+			r, maxAge = &robots{}, robotsErrorMaxAge
+		} else if r.disallowAll {
+			maxAge = robotsErrorMaxAge
+		}
+		hd.robotsCache.set(host, r, maxAge)
+	}
+
+	if r.crawlDelay > 0 && hd.Options.RateLimit != nil {
+		hd.limiter.setMinDelay(req.URL.Hostname(), hd.Options.RateLimit, r.crawlDelay)
+	}
+
+	if !r.allowed(req.URL.RequestURI()) {
+		return fmt.Errorf("%w (%s)", ErrDisallowedByRobots, req.URL.String())
+	}
+	return nil
+}
+
+// Fetch and parse robots.txt for the host of req.
+func (hd *HTTPDisk) robots(req *http.Request) (*robots, error) {
+	// Detach from the caller's context so partitions and request options don't
+	// apply to robots.txt, but still honor cancellation.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-req.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	robotsURL := fmt.Sprintf("%s://%s/robots.txt", req.URL.Scheme, req.URL.Host)
+	robotsReq, err := http.NewRequestWithContext(ctx, "GET", robotsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	robotsReq.Header.Set("User-Agent", hd.Options.RobotsUserAgent)
+
+	// use a client so that redirects are followed
+	client := http.Client{Transport: robotsTransport{hd}}
+	resp, err := client.Do(robotsReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		// server error, assume complete disallow (RFC 9309 2.3.1.4)
+		return &robots{disallowAll: true}, nil
+	case resp.StatusCode >= 400:
+		// unavailable, assume complete allow (RFC 9309 2.3.1.3)
+		return &robots{}, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRobotsSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseRobots(string(data), hd.Options.RobotsUserAgent), nil
+}
+
+// robotsTransport reads robots.txt from the cache if it is younger than
+// robotsMaxAge, and fetches it otherwise. Force, Rules and MaxAge don't apply.
+// Errors are never stored, and if the server can't be reached the stale copy
+// is used instead (RFC 9309 2.4). Concurrent fetches for the same robots.txt
+// are coalesced.
+type robotsTransport struct {
+	hd *HTTPDisk
+}
+
+func (t robotsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hd := t.hd
+	cacheKey, err := NewCacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stale, _ := hd.readFromCache(cacheKey)
+	if stale != nil && isHttpError(stale.Response) {
+		// stored by an older version, don't trust it
+		stale = nil
+	}
+	if stale != nil && stale.Age <= robotsMaxAge {
+		return stale.Response, nil
+	}
+
+	opts := fetchOptions{store: true}
+	resp, _, err := hd.inflight.do(req.Context(), flightKey(req, cacheKey, opts), func() (*http.Response, bool, error) {
+		return hd.fetch(req, cacheKey, opts)
+	})
+	if stale != nil && (err != nil || isServerError(resp)) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return stale.Response, nil
+	}
+	return resp, err
+}
+
+//
+// robots.txt parsing
+//
+
+// rules from robots.txt that apply to our user agent
+type robots struct {
+	disallowAll bool
+	rules       []robotsRule
+	crawlDelay  time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// a user-agent group while parsing
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// Parse robots.txt, keeping the rules for the group that best matches
+// userAgent, or the * group if nothing matches.
+func parseRobots(data string, userAgent string) *robots {
+	// "MyBot/1.0 (+http://mybot.com)" => "mybot"
+	product := "*"
+	if fields := strings.Fields(userAgent); len(fields) > 0 {
+		product = strings.ToLower(strings.SplitN(fields[0], "/", 2)[0])
+	}
+
+	var groups []*robotsGroup
+	var group *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				group = &robotsGroup{}
+				groups = append(groups, group)
+				inAgents = true
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if group == nil || value == "" {
+				continue
+			}
+			group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value, re: robotsPattern(value)})
+		case "crawl-delay":
+			inAgents = false
+			if group == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				group.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	// combine matching groups, preferring our product token over *
+	robots := &robots{}
+	for _, want := range []string{product, "*"} {
+		found := false
+		for _, group := range groups {
+			for _, agent := range group.agents {
+				if agent == want {
+					robots.rules = append(robots.rules, group.rules...)
+					if group.crawlDelay > robots.crawlDelay {
+						robots.crawlDelay = group.crawlDelay
+					}
+					found = true
+					break
+				}
+			}
+		}
+		if found {
+			break
+		}
+	}
+	return robots
+}
+
+// Turn a robots.txt path pattern into a regexp. Supports * and $.
+func robotsPattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i, r := range pattern {
+		switch {
+		case r == '*':
+			sb.WriteString(".*")
+		case r == '$' && i == len(pattern)-1:
+			sb.WriteString("$")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return regexp.MustCompile(sb.String())
+}
+
+// Is this path allowed? The longest matching rule wins, and allow wins ties.
+func (robots *robots) allowed(path string) bool {
+	if robots.disallowAll {
+		return false
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+
+	allowed, longest := true, -1
+	for _, rule := range robots.rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			allowed, longest = rule.allow, len(rule.pattern)
+		}
+	}
+	return allowed
+}
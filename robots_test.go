@@ -0,0 +1,232 @@
+package gohttpdisk
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRobots = `
+# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+
+User-agent: MyBot
+User-agent: OtherBot
+Disallow: /*.pdf$
+Disallow: /search
+Allow: /search/about
+Crawl-delay: 0.5
+`
+
+func TestParseRobots(t *testing.T) {
+	robots := parseRobots(testRobots, "MyBot/1.0 (+http://mybot.com)")
+	assert.True(t, robots.allowed("/"))
+	assert.True(t, robots.allowed("/private"))
+	assert.False(t, robots.allowed("/a/b.pdf"))
+	assert.True(t, robots.allowed("/a/b.pdf?x=1"))
+	assert.False(t, robots.allowed("/search?q=1"))
+	assert.True(t, robots.allowed("/search/about"))
+	assert.Equal(t, 500*time.Millisecond, robots.crawlDelay)
+
+	// falls back to *
+	robots = parseRobots(testRobots, "Unknown")
+	assert.False(t, robots.allowed("/private/x"))
+	assert.True(t, robots.allowed("/private/public/x"))
+	assert.True(t, robots.allowed("/search"))
+	assert.Equal(t, time.Duration(0), robots.crawlDelay)
+
+	// empty
+	assert.True(t, parseRobots("", "MyBot").allowed("/anything"))
+}
+
+func TestHTTPDiskRobots(t *testing.T) {
+	var robotsFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&robotsFetches, 1)
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot", RateLimit: &RateLimit{}})
+
+	_, err := hd.RoundTrip(MustRequest("GET", server.URL+"/search"))
+	assert.True(t, errors.Is(err, ErrDisallowedByRobots))
+
+	resp, err := hd.RoundTrip(MustRequest("GET", server.URL+"/hello"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	// robots.txt is cached
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robotsFetches))
+
+	// crawl delay applies to the next request
+	start := time.Now()
+	hd.RoundTrip(MustRequest("GET", server.URL+"/hello2"))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+}
+
+func TestHTTPDiskRobotsErrors(t *testing.T) {
+	status := 404
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot", ForceErrors: true})
+
+	// 4xx means allow
+	_, err := hd.RoundTrip(MustRequest("GET", server.URL+"/a"))
+	assert.NoError(t, err)
+
+	// 5xx means disallow, but it isn't stored
+	status = 503
+	hd = NewHTTPDisk(hd.Options)
+	_, err = hd.RoundTrip(MustRequest("GET", server.URL+"/b"))
+	assert.True(t, errors.Is(err, ErrDisallowedByRobots))
+	data, _, _ := hd.Cache.Get(MustCacheKey(MustRequest("GET", server.URL+"/robots.txt")))
+	assert.Empty(t, data)
+
+	// so the host is allowed again once robots.txt recovers
+	status = 200
+	hd = NewHTTPDisk(hd.Options)
+	_, err = hd.RoundTrip(MustRequest("GET", server.URL+"/c"))
+	assert.NoError(t, err)
+}
+
+func TestHTTPDiskRobotsFreshness(t *testing.T) {
+	var robotsFetches int32
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&robotsFetches, 1)
+			w.WriteHeader(status)
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot", Force: true})
+	options := hd.Options
+
+	// Force doesn't apply to robots.txt, which is kept in memory
+	hd.RoundTrip(MustRequest("GET", server.URL+"/a"))
+	hd.RoundTrip(MustRequest("GET", server.URL+"/b"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robotsFetches))
+
+	// or read from disk
+	hd = NewHTTPDisk(options)
+	hd.RoundTrip(MustRequest("GET", server.URL+"/c"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robotsFetches))
+
+	// but refetched once it's a day old, even though MaxAge is 0
+	ageRobots := func() {
+		path := hd.Cache.diskpath(MustCacheKey(MustRequest("GET", server.URL+"/robots.txt")))
+		old := time.Now().Add(-robotsMaxAge - time.Hour)
+		assert.NoError(t, os.Chtimes(path, old, old))
+	}
+	ageRobots()
+	hd = NewHTTPDisk(options)
+	hd.RoundTrip(MustRequest("GET", server.URL+"/d"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&robotsFetches))
+
+	// if the refetch fails, the old copy is still used
+	ageRobots()
+	status = 503
+	hd = NewHTTPDisk(options)
+	_, err := hd.RoundTrip(MustRequest("GET", server.URL+"/e"))
+	assert.NoError(t, err)
+	_, err = hd.RoundTrip(MustRequest("GET", server.URL+"/search"))
+	assert.True(t, errors.Is(err, ErrDisallowedByRobots))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&robotsFetches))
+}
+
+func TestHTTPDiskRobotsGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRobots)
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot", GzipResponses: true})
+	options := hd.Options
+
+	// robots.txt is parsed decoded, whether it was fetched or read from disk
+	_, err := hd.RoundTrip(MustRequest("GET", server.URL+"/search"))
+	assert.True(t, errors.Is(err, ErrDisallowedByRobots))
+	hd = NewHTTPDisk(options)
+	_, err = hd.RoundTrip(MustRequest("GET", server.URL+"/search"))
+	assert.True(t, errors.Is(err, ErrDisallowedByRobots))
+}
+
+func TestHTTPDiskRobotsConcurrent(t *testing.T) {
+	var robotsFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&robotsFetches, 1)
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot"})
+
+	// a cold host gets one robots.txt fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := hd.RoundTrip(MustRequest("GET", fmt.Sprintf("%s/%d", server.URL, i)))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robotsFetches))
+}
+
+func TestHTTPDiskRobotsNetworkError(t *testing.T) {
+	var robotsFetches int32
+	hd := TmpHTTPDisk(t, Options{RobotsUserAgent: "MyBot"})
+	hd.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt32(&robotsFetches, 1)
+			return nil, errors.New("connection refused")
+		}
+		return newResponse(r, 200, "hello"), nil
+	})
+
+	// the host is allowed, and robots.txt isn't refetched for a while
+	for _, path := range []string{"/a", "/b", "/c"} {
+		_, err := hd.RoundTrip(MustRequest("GET", "http://robots.test"+path))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&robotsFetches))
+
+	// but it is once that has passed
+	hd.robotsCache.set("http://robots.test", &robots{}, 0)
+	hd.RoundTrip(MustRequest("GET", "http://robots.test/d"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&robotsFetches))
+}
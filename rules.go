@@ -0,0 +1,99 @@
+package gohttpdisk
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rule applies a Policy to matching requests. Empty fields match everything,
+// so a Rule with only Host set applies to every request for that host.
+type Rule struct {
+	// Host glob, like "*.example.com" (see path.Match). Matched against the
+	// lowercase hostname, without the port.
+	Host string
+
+	// Regexp matched against the URL path, like "^/login".
+	Path *regexp.Regexp
+
+	// HTTP methods, like "GET" or "POST".
+	Methods []string
+
+	// Policy for matching requests.
+	Policy Policy
+}
+
+// Policy overrides the global freshness and error options for requests that
+// match a Rule. Fields left at their zero value inherit from Options, so a
+// Policy that only sets NoCacheErrors still uses Options.MaxAge.
+type Policy struct {
+	// Like Options.MaxAge. Zero inherits Options.MaxAge, and a negative value
+	// means that cached responses are always fresh.
+	MaxAge time.Duration
+
+	// Don't read or write cached errors, either network errors or http errors.
+	NoCacheErrors bool
+
+	// Like Options.StaleIfError. Zero inherits Options.StaleIfError, and a
+	// negative value turns it off.
+	StaleIfError time.Duration
+
+	// Turn on Options.StaleWhileRevalidate.
+	StaleWhileRevalidate bool
+
+	// Turn off Options.StaleWhileRevalidate.
+	NoStaleWhileRevalidate bool
+
+	// Don't read from or write to the cache at all.
+	Bypass bool
+}
+
+// Returns the Policy from the first Rule that matches, or nil.
+func matchRules(rules []Rule, req *http.Request) *Policy {
+	for i := range rules {
+		if rules[i].matches(req) {
+			return &rules[i].Policy
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) matches(req *http.Request) bool {
+	if rule.Host != "" {
+		ok, err := path.Match(strings.ToLower(rule.Host), strings.ToLower(req.URL.Hostname()))
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if rule.Path != nil {
+		urlPath := req.URL.Path
+		if urlPath == "" {
+			urlPath = "/"
+		}
+		if !rule.Path.MatchString(urlPath) {
+			return false
+		}
+	}
+
+	if len(rule.Methods) > 0 {
+		method := req.Method
+		if method == "" {
+			method = "GET"
+		}
+		found := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
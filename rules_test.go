@@ -0,0 +1,70 @@
+package gohttpdisk
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleMatches(t *testing.T) {
+	rules := []Rule{
+		{Path: regexp.MustCompile("^/login"), Policy: Policy{Bypass: true}},
+		{Host: "*.example.com", Methods: []string{"GET"}, Policy: Policy{MaxAge: time.Hour}},
+		{Host: "static.com", Policy: Policy{}},
+	}
+
+	assert.True(t, matchRules(rules, MustRequest("GET", "http://a.com/login")).Bypass)
+	assert.Equal(t, time.Hour, matchRules(rules, MustRequest("GET", "http://www.EXAMPLE.com/")).MaxAge)
+	assert.Nil(t, matchRules(rules, MustRequest("POST", "http://www.example.com/")))
+	assert.Nil(t, matchRules(rules, MustRequest("GET", "http://example.com/")))
+	assert.NotNil(t, matchRules(rules, MustRequest("GET", "http://static.com:8080/a.png")))
+	assert.Nil(t, matchRules(rules, MustRequest("GET", "http://other.com/")))
+}
+
+func TestRulesRoundTrip(t *testing.T) {
+	hd := NewHTTPDisk(Options{
+		Dir:    TmpDir(),
+		MaxAge: time.Hour,
+		Rules: []Rule{
+			{Path: regexp.MustCompile("^/login"), Policy: Policy{Bypass: true}},
+			{Host: "news.com", Policy: Policy{MaxAge: 10 * time.Millisecond}},
+			{Host: "flaky.com", Policy: Policy{NoCacheErrors: true}},
+			{Host: "static.com", Policy: Policy{MaxAge: -1}},
+		},
+	})
+	hd.Cache.RemoveAll()
+	defer hd.Cache.RemoveAll()
+	hd.Transport = &counterRoundTripper{}
+
+	get := func(url string) string {
+		resp, err := hd.RoundTrip(MustRequest("GET", url))
+		if err != nil {
+			t.Fatalf("Get %s failed %s", url, err)
+		}
+		return resp.Header.Get("X-Request-Id")
+	}
+
+	// bypass
+	assert.Equal(t, "1", get("http://a.com/login"))
+	assert.Equal(t, "2", get("http://a.com/login"))
+
+	// global MaxAge
+	assert.Equal(t, "3", get("http://a.com/"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "3", get("http://a.com/"))
+
+	// rule MaxAge
+	assert.Equal(t, "4", get("http://news.com/"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "5", get("http://news.com/"))
+
+	// unset fields inherit the global MaxAge
+	settings := hd.settings(MustRequest("GET", "http://flaky.com/"))
+	assert.Equal(t, time.Hour, settings.maxAge)
+	assert.False(t, settings.cacheErrors)
+
+	// negative MaxAge is fresh forever
+	assert.False(t, hd.isStale(&CacheEntry{Response: newResponse(nil, 200, ""), Age: 1000 * time.Hour}, hd.settings(MustRequest("GET", "http://static.com/"))))
+}
@@ -0,0 +1,47 @@
+package gohttpdisk
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters for an HTTPDisk. See HTTPDisk.Stats.
+type Stats struct {
+	// Network requests, including retries
+	Fetches int64
+
+	// Retries because of Options.Retry
+	Retries int64
+
+	// Number of times we waited because of Retry-After, and the total wait
+	RetryAfterWaits int64
+	RetryAfterWait  time.Duration
+
+	// Number of times we waited because of Options.RateLimit, and the total
+	// wait
+	ThrottleWaits int64
+	ThrottleWait  time.Duration
+}
+
+// counters, updated atomically
+type stats struct {
+	fetches         int64
+	retries         int64
+	retryAfterWaits int64
+	retryAfterWait  int64
+	throttleWaits   int64
+	throttleWait    int64
+}
+
+// Stats returns a snapshot of the counters.
+func (hd *HTTPDisk) Stats() Stats {
+	s := &hd.stats
+	return Stats{
+		Fetches:         atomic.LoadInt64(&s.fetches),
+		Retries:         atomic.LoadInt64(&s.retries),
+		RetryAfterWaits: atomic.LoadInt64(&s.retryAfterWaits),
+		RetryAfterWait:  time.Duration(atomic.LoadInt64(&s.retryAfterWait)),
+		ThrottleWaits:   atomic.LoadInt64(&s.throttleWaits),
+		ThrottleWait:    time.Duration(atomic.LoadInt64(&s.throttleWait)),
+	}
+}
@@ -61,3 +61,29 @@ func TmpDir() string {
 	}
 	return dir
 }
+
+// the parts of testing.TB that the helpers below use
+type testingT interface {
+	Cleanup(func())
+	Fatalf(format string, args ...interface{})
+	Helper()
+}
+
+// create an HTTPDisk with its own temp dir, which is removed when the test is
+// done. options.Dir is ignored.
+func TmpHTTPDisk(t testingT, options Options) *HTTPDisk {
+	options.Dir = TmpDir()
+	hd := NewHTTPDisk(options)
+	t.Cleanup(func() { hd.Cache.RemoveAll() })
+	return hd
+}
+
+// round trip req, failing the test on error
+func MustRoundTrip(t testingT, hd *HTTPDisk, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := hd.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip %s failed %s", req.URL, err)
+	}
+	return resp
+}